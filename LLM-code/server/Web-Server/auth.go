@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Passwords are stored as salted PBKDF2-HMAC-SHA256 hashes in the form
+// "pbkdf2-sha256$<iterations>$<salt>$<hash>", salt and hash base64-encoded.
+// The iteration count follows the OWASP recommendation for PBKDF2-SHA256.
+const (
+	passwordScheme     = "pbkdf2-sha256"
+	passwordIterations = 600_000
+	passwordSaltLen    = 16
+	passwordHashLen    = 32
+)
+
+// hashPassword returns the encoded hash of password with a fresh salt.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, passwordHashLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password matches an encoded hash.
+func checkPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// Accounts holds the usernames and password hashes of those who may log
+// in. It is safe for concurrent use.
+type Accounts struct {
+	mu     sync.RWMutex
+	hashes map[string]string
+	// dummy is checked against when the username is unknown, so that a
+	// failed login takes as long whether or not the user exists.
+	dummy string
+}
+
+// NewAccounts returns an empty set of accounts.
+func NewAccounts() (*Accounts, error) {
+	dummy, err := hashPassword(randomToken())
+	if err != nil {
+		return nil, err
+	}
+	return &Accounts{hashes: make(map[string]string), dummy: dummy}, nil
+}
+
+// Add creates or replaces an account.
+func (a *Accounts) Add(username, password string) error {
+	if username == "" || password == "" {
+		return errors.New("username and password must not be empty")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.hashes[username] = hash
+	return nil
+}
+
+// Authenticate reports whether username exists and password is theirs.
+func (a *Accounts) Authenticate(username, password string) bool {
+	a.mu.RLock()
+	hash, ok := a.hashes[username]
+	a.mu.RUnlock()
+	if !ok {
+		checkPassword(a.dummy, password)
+		return false
+	}
+	return checkPassword(hash, password)
+}
+
+// Login attempts are limited per client IP and per username from that IP,
+// counted over a loginWindow, so that passwords can't be guessed quickly
+// and each client can only make the server hash so many (every check costs
+// passwordIterations rounds). A successful login clears the pair's count.
+//
+// The account limit is keyed on the IP as well because it is charged
+// before the password is checked: counted per username alone, anyone could
+// lock out admin with a few bad requests. The price is that an attacker
+// spread over many addresses gets maxLoginsPerAccount guesses from each;
+// only strong passwords help against that.
+const (
+	loginWindow         = 15 * time.Minute
+	maxLoginsPerIP      = 30
+	maxLoginsPerAccount = 10
+)
+
+// loginLimiter counts login attempts per key ("ip:..." or "user:...") in
+// fixed windows. It is safe for concurrent use.
+type loginLimiter struct {
+	mu       sync.Mutex
+	attempts map[string]*loginAttempts
+	swept    time.Time
+}
+
+type loginAttempts struct {
+	count int
+	start time.Time
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{attempts: make(map[string]*loginAttempts)}
+}
+
+// allow counts an attempt from ip for username and reports whether it may
+// go ahead, and if not, how long until it may.
+func (l *loginLimiter) allow(ip, username string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.sweepLocked(now)
+	ipKey, userKey := "ip:"+ip, accountKey(ip, username)
+	if wait := l.waitLocked(ipKey, maxLoginsPerIP, now); wait > 0 {
+		return false, wait
+	}
+	if wait := l.waitLocked(userKey, maxLoginsPerAccount, now); wait > 0 {
+		return false, wait
+	}
+	l.attempts[ipKey].count++
+	l.attempts[userKey].count++
+	return true, 0
+}
+
+// waitLocked returns how long until key may try again, or 0 if it is under
+// limit, creating its entry if needed. Callers must hold l.mu.
+func (l *loginLimiter) waitLocked(key string, limit int, now time.Time) time.Duration {
+	a, ok := l.attempts[key]
+	if !ok || now.Sub(a.start) >= loginWindow {
+		a = &loginAttempts{start: now}
+		l.attempts[key] = a
+	}
+	if a.count < limit {
+		return 0
+	}
+	return a.start.Add(loginWindow).Sub(now)
+}
+
+// succeeded clears the count for username from ip after a successful
+// login.
+func (l *loginLimiter) succeeded(ip, username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.attempts, accountKey(ip, username))
+}
+
+// accountKey is the limiter key for attempts at username from ip.
+func accountKey(ip, username string) string {
+	return "user:" + ip + "|" + username
+}
+
+// sweepLocked drops finished windows, at most once a minute. Callers must
+// hold l.mu.
+func (l *loginLimiter) sweepLocked(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for key, a := range l.attempts {
+		if now.Sub(a.start) >= loginWindow {
+			delete(l.attempts, key)
+		}
+	}
+}
+
+// remoteIP returns the IP address the request came from.
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// loginView is the data of the login page.
+type loginView struct {
+	Username  string
+	Error     string
+	CSRFToken string
+}
+
+// LoginPageHandler: the login form. JSON clients get just the CSRF token
+// to send with their login request.
+func (a *App) LoginPageHandler(w http.ResponseWriter, r *http.Request) {
+	s, r := a.sessions.Ensure(w, r)
+	if !wantsHTML(r) {
+		jsonResponse(w, http.StatusOK, map[string]string{"csrf_token": s.CSRFToken})
+		return
+	}
+	a.views.Render(w, r, http.StatusOK, "Log in", "login", loginView{CSRFToken: s.CSRFToken})
+}
+
+// LoginHandler: checks the username and password (as form fields or JSON)
+// and, if they match, starts a new session for the user. Browsers are
+// sent to the home page; JSON clients get the new session's CSRF token.
+func (a *App) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	var creds struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	isJSON := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	if isJSON {
+		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+			jsonError(w, http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+	} else {
+		creds.Username = r.PostFormValue("username")
+		creds.Password = r.PostFormValue("password")
+	}
+
+	if ok, wait := a.logins.allow(remoteIP(r), creds.Username); !ok {
+		loggerFrom(r.Context()).Warn("Login throttled", "username", creds.Username, "client_ip", r.RemoteAddr)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		if isJSON || !wantsHTML(r) {
+			jsonError(w, http.StatusTooManyRequests, "Too many login attempts; try again later")
+			return
+		}
+		view := loginView{Username: creds.Username, Error: "Too many login attempts. Try again later.", CSRFToken: sessionFrom(r.Context()).CSRFToken}
+		a.views.Render(w, r, http.StatusTooManyRequests, "Log in", "login", view)
+		return
+	}
+	if !a.accounts.Authenticate(creds.Username, creds.Password) {
+		loggerFrom(r.Context()).Warn("Failed login", "username", creds.Username, "client_ip", r.RemoteAddr)
+		if isJSON || !wantsHTML(r) {
+			jsonError(w, http.StatusUnauthorized, "Invalid username or password")
+			return
+		}
+		view := loginView{Username: creds.Username, Error: "Invalid username or password.", CSRFToken: sessionFrom(r.Context()).CSRFToken}
+		a.views.Render(w, r, http.StatusUnauthorized, "Log in", "login", view)
+		return
+	}
+
+	a.logins.succeeded(remoteIP(r), creds.Username)
+	s := a.sessions.Login(w, r, creds.Username)
+	loggerFrom(r.Context()).Info("Logged in", "username", creds.Username, "client_ip", r.RemoteAddr)
+	switch {
+	case isJSON || !wantsHTML(r):
+		jsonResponse(w, http.StatusOK, map[string]string{"username": s.Username, "csrf_token": s.CSRFToken})
+	case isHTMX(r):
+		w.Header().Set("HX-Redirect", "/")
+	default:
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+// LogoutHandler: ends the session.
+func (a *App) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if user := currentUser(r); user != "" {
+		loggerFrom(r.Context()).Info("Logged out", "username", user)
+	}
+	a.sessions.Logout(w, r)
+	switch {
+	case isHTMX(r):
+		w.Header().Set("HX-Redirect", "/")
+	case wantsHTML(r):
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
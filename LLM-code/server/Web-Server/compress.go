@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultCompressMinSize is the response size below which compressing
+// isn't worth it: the result would still fit in one TCP segment.
+const defaultCompressMinSize = 1024
+
+// Content types that are compressed already, so compressing them again
+// only costs CPU. Other image/, audio/ and video/ types are skipped too.
+var incompressibleTypes = map[string]bool{
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/zip":              true,
+	"application/zstd":             true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/pdf":              true,
+	"application/octet-stream":     true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+}
+
+// compressible reports whether a response of this Content-Type is worth
+// compressing.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if incompressibleTypes[mediaType] {
+		return false
+	}
+	typ, subtype, _ := strings.Cut(mediaType, "/")
+	switch typ {
+	case "image":
+		return subtype == "svg+xml"
+	case "audio", "video":
+		return false
+	}
+	return true
+}
+
+// negotiateEncoding picks gzip or deflate, whichever Accept-Encoding gives
+// the higher q (gzip on a tie), or "" if it allows neither. "*" stands for
+// any coding not listed by name.
+func negotiateEncoding(header string) string {
+	q := map[string]float64{}
+	for part := range strings.SplitSeq(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			w, err := strconv.ParseFloat(v, 64)
+			if err != nil || w < 0 || w > 1 {
+				continue
+			}
+			weight = w
+		}
+		q[coding] = weight
+	}
+	best, bestQ := "", 0.0
+	for _, coding := range []string{"gzip", "deflate"} {
+		w, ok := q[coding]
+		if !ok {
+			w = q["*"]
+		}
+		if w > bestQ {
+			best, bestQ = coding, w
+		}
+	}
+	return best
+}
+
+// Encoders are reused; setting one up allocates several hundred KB. The
+// "deflate" content coding is the zlib format (RFC 9110, section 8.4.1.2),
+// not raw DEFLATE.
+var (
+	gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+	zlibWriters = sync.Pool{New: func() any { return zlib.NewWriter(io.Discard) }}
+)
+
+// encoder is what gzip.Writer and zlib.Writer have in common.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// CompressMiddleware compresses responses with gzip or deflate, as the
+// request's Accept-Encoding allows. Responses smaller than minSize bytes,
+// of already compressed types, without a body, or already encoded by the
+// handler are sent as they are.
+func CompressMiddleware(next http.Handler, minSize int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Whether or not this response gets compressed, another request
+		// for the same URL might be, so caches must look at the header.
+		w.Header().Add("Vary", "Accept-Encoding")
+		coding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if coding == "" || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{wrappedWriter: wrappedWriter{w}, coding: coding, minSize: minSize, status: http.StatusOK}
+		next.ServeHTTP(exposeLike(cw, w), r)
+		cw.close()
+	})
+}
+
+// compressWriter holds back the first minSize bytes of a response, then
+// decides whether to compress it. Until it has decided, the status code is
+// held back too, since Content-Encoding and Content-Length depend on it.
+type compressWriter struct {
+	wrappedWriter
+	coding  string
+	minSize int
+
+	status      int
+	wroteHeader bool   // the handler called WriteHeader or Write
+	decided     bool   // headers have gone out
+	buf         []byte // held back until decided
+	enc         encoder
+	hijacked    bool
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader || cw.decided {
+		return
+	}
+	if code < 200 {
+		// Informational responses go out as they are.
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.status, cw.wroteHeader = code, true
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		if len(cw.buf)+len(b) < cw.minSize {
+			cw.buf = append(cw.buf, b...)
+			return len(b), nil
+		}
+		if cw.Header().Get("Content-Type") == "" {
+			// Sniff from b too: the buffer may hold little or nothing.
+			cw.Header().Set("Content-Type", http.DetectContentType(append(cw.buf, b...)))
+		}
+		cw.decide(true)
+		if err := cw.flushBuf(); err != nil {
+			return 0, err
+		}
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// decide sends the headers, compressing if big is set and the response is
+// eligible.
+func (cw *compressWriter) decide(big bool) {
+	cw.decided = true
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		// net/http would sniff the compressed bytes instead.
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	bodyless := cw.status == http.StatusNoContent || cw.status == http.StatusNotModified
+	if big && !bodyless && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", cw.coding)
+		// The handler's length, if any, is the uncompressed one.
+		h.Del("Content-Length")
+		if cw.coding == "gzip" {
+			cw.enc = gzipWriters.Get().(*gzip.Writer)
+		} else {
+			cw.enc = zlibWriters.Get().(*zlib.Writer)
+		}
+		cw.enc.Reset(cw.ResponseWriter)
+	} else if !bodyless && h.Get("Content-Length") == "" && !big {
+		h.Set("Content-Length", strconv.Itoa(len(cw.buf)))
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+// flushBuf writes out what was held back.
+func (cw *compressWriter) flushBuf() error {
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush sends what has been written so far. A response that is flushed
+// before reaching minSize is taken to be a stream and compressed anyway.
+func (cw *compressWriter) Flush() {
+	cw.FlushError()
+}
+
+// FlushError is Flush, reporting whether it worked.
+func (cw *compressWriter) FlushError() error {
+	if cw.hijacked {
+		return nil
+	}
+	if !cw.decided {
+		if !cw.wroteHeader {
+			cw.WriteHeader(http.StatusOK)
+		}
+		cw.decide(true)
+		if err := cw.flushBuf(); err != nil {
+			return err
+		}
+	}
+	if cw.enc != nil {
+		if err := cw.enc.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := cw.wrappedWriter.Hijack()
+	if err == nil {
+		cw.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// ReadFrom compresses what it copies, unless the response has already
+// been sent uncompressed, in which case the wrapped writer's ReadFrom can
+// do the copying.
+func (cw *compressWriter) ReadFrom(src io.Reader) (int64, error) {
+	if cw.decided && cw.enc == nil {
+		return cw.wrappedWriter.ReadFrom(src)
+	}
+	return io.Copy(writerOnly{cw}, src)
+}
+
+// close finishes the response once the handler has returned.
+func (cw *compressWriter) close() {
+	if cw.hijacked {
+		return
+	}
+	if !cw.decided {
+		if !cw.wroteHeader {
+			// The handler wrote nothing; let net/http send its default.
+			return
+		}
+		cw.decide(false)
+		cw.flushBuf()
+		return
+	}
+	if cw.enc == nil {
+		return
+	}
+	cw.enc.Close()
+	cw.enc.Reset(io.Discard)
+	if gz, ok := cw.enc.(*gzip.Writer); ok {
+		gzipWriters.Put(gz)
+	} else {
+		zlibWriters.Put(cw.enc)
+	}
+	cw.enc = nil
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the server's configuration. It is built from DefaultConfig,
+// then a JSON or TOML file, then environment variables, then flags, each
+// overriding the one before. The file's keys are the json tags below, with
+// the nested structs as tables.
+type Config struct {
+	Server      ServerConfig      `json:"server"`
+	TLS         TLSConfig         `json:"tls"`
+	Log         LogConfig         `json:"log"`
+	CORS        CORSConfig        `json:"cors"`
+	Security    SecurityConfig    `json:"security"`
+	Session     SessionConfig     `json:"session"`
+	Compression CompressionConfig `json:"compression"`
+	Admin       AdminConfig       `json:"admin"`
+}
+
+type ServerConfig struct {
+	Addr              string   `json:"addr"`
+	ReadTimeout       Duration `json:"read_timeout"`
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	WriteTimeout      Duration `json:"write_timeout"`
+	IdleTimeout       Duration `json:"idle_timeout"`
+	ShutdownTimeout   Duration `json:"shutdown_timeout"`
+	MaxHeaderBytes    int      `json:"max_header_bytes"`
+}
+
+// TLSConfig turns on HTTPS when CertFile and KeyFile or SelfSigned are set.
+type TLSConfig struct {
+	CertFile     string `json:"cert_file"`
+	KeyFile      string `json:"key_file"`
+	SelfSigned   bool   `json:"self_signed"`
+	RedirectAddr string `json:"redirect_addr"` // plain HTTP listener redirecting to HTTPS
+}
+
+type LogConfig struct {
+	Format string `json:"format"` // "text" or "json"
+	Level  string `json:"level"`  // "debug", "info", "warn" or "error"
+}
+
+type CORSConfig struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           Duration `json:"max_age"`
+}
+
+type SecurityConfig struct {
+	HSTSMaxAge Duration `json:"hsts_max_age"`
+}
+
+type SessionConfig struct {
+	// SecureCookie sets the session cookie's Secure attribute. Only turn it
+	// off to serve plain HTTP from somewhere other than localhost.
+	SecureCookie bool `json:"secure_cookie"`
+}
+
+type CompressionConfig struct {
+	Enabled bool `json:"enabled"`
+	MinSize int  `json:"min_size"`
+}
+
+type AdminConfig struct {
+	User     string `json:"user"`
+	Password Secret `json:"password"` // if empty, generated on an interactive start
+}
+
+// DefaultConfig returns the configuration used where nothing else is set.
+func DefaultConfig() Config {
+	policy := DefaultSecurityPolicy()
+	return Config{
+		Server: ServerConfig{
+			Addr:              ":8080",
+			ReadTimeout:       Duration(10 * time.Second),
+			ReadHeaderTimeout: Duration(5 * time.Second),
+			WriteTimeout:      Duration(10 * time.Second),
+			IdleTimeout:       Duration(2 * time.Minute),
+			ShutdownTimeout:   Duration(5 * time.Second),
+			MaxHeaderBytes:    64 << 10,
+		},
+		Log:         LogConfig{Format: "text", Level: "info"},
+		CORS:        CORSConfig{MaxAge: Duration(policy.CORS.MaxAge)},
+		Security:    SecurityConfig{HSTSMaxAge: Duration(policy.HSTSMaxAge)},
+		Session:     SessionConfig{SecureCookie: true},
+		Compression: CompressionConfig{Enabled: true, MinSize: defaultCompressMinSize},
+		Admin:       AdminConfig{User: "admin"},
+	}
+}
+
+// Duration is a time.Duration written as a string such as "10s" in config
+// files.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("invalid duration %s: must be a string such as \"10s\"", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Secret is a string, such as a password, that is never printed or
+// logged.
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) { return json.Marshal(s.String()) }
+func (s Secret) LogValue() slog.Value         { return slog.StringValue(s.String()) }
+
+// String returns the configuration as JSON, with secrets redacted.
+func (c Config) String() string {
+	b, _ := json.MarshalIndent(c, "", "  ")
+	return string(b)
+}
+
+// LoadConfig builds the configuration from the file named by -config or
+// CONFIG_FILE, the environment and the command-line arguments, and
+// validates it. printOnly is set if -print-config asks for the result to
+// be printed instead of served.
+func LoadConfig(args []string) (cfg Config, printOnly bool, err error) {
+	// Flags come last but name the file, so they are parsed twice: first
+	// into a scratch Config to find the file, then onto the real one.
+	scratch := DefaultConfig()
+	fs, path, printOnlyFlag := configFlags(&scratch)
+	if err := fs.Parse(args); err != nil {
+		return Config{}, false, err
+	}
+	if fs.NArg() > 0 {
+		return Config{}, false, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	cfg = DefaultConfig()
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return Config{}, false, err
+		}
+	}
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return Config{}, false, err
+	}
+	fs, _, _ = configFlags(&cfg)
+	fs.Parse(args)
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, false, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, *printOnlyFlag, nil
+}
+
+// configFlags defines the command-line flags, writing to cfg.
+func configFlags(cfg *Config) (fs *flag.FlagSet, path *string, printOnly *bool) {
+	fs = flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	path = fs.String("config", os.Getenv("CONFIG_FILE"), "JSON or TOML config `file` (env CONFIG_FILE)")
+	printOnly = fs.Bool("print-config", false, "print the configuration, secrets redacted, and exit")
+
+	s := &cfg.Server
+	fs.StringVar(&s.Addr, "addr", s.Addr, "listen `address` (env PORT sets the port)")
+	fs.DurationVar((*time.Duration)(&s.ReadTimeout), "read-timeout", time.Duration(s.ReadTimeout), "time to read a whole request (env READ_TIMEOUT)")
+	fs.DurationVar((*time.Duration)(&s.ReadHeaderTimeout), "read-header-timeout", time.Duration(s.ReadHeaderTimeout), "time to read request headers (env READ_HEADER_TIMEOUT)")
+	fs.DurationVar((*time.Duration)(&s.WriteTimeout), "write-timeout", time.Duration(s.WriteTimeout), "time to write a response (env WRITE_TIMEOUT)")
+	fs.DurationVar((*time.Duration)(&s.IdleTimeout), "idle-timeout", time.Duration(s.IdleTimeout), "time to keep idle connections open (env IDLE_TIMEOUT)")
+	fs.DurationVar((*time.Duration)(&s.ShutdownTimeout), "shutdown-timeout", time.Duration(s.ShutdownTimeout), "time to let requests finish on shutdown (env SHUTDOWN_TIMEOUT)")
+	fs.IntVar(&s.MaxHeaderBytes, "max-header-bytes", s.MaxHeaderBytes, "maximum size of request headers (env MAX_HEADER_BYTES)")
+
+	t := &cfg.TLS
+	fs.StringVar(&t.CertFile, "tls-cert", t.CertFile, "PEM certificate `file` (env TLS_CERT_FILE)")
+	fs.StringVar(&t.KeyFile, "tls-key", t.KeyFile, "PEM key `file` (env TLS_KEY_FILE)")
+	fs.BoolVar(&t.SelfSigned, "tls-self-signed", t.SelfSigned, "serve HTTPS with a generated certificate, for development (env TLS_SELF_SIGNED)")
+	fs.StringVar(&t.RedirectAddr, "redirect-addr", t.RedirectAddr, "`address` of an HTTP listener redirecting to HTTPS (env REDIRECT_PORT sets the port)")
+
+	fs.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "log format: text or json (env LOG_FORMAT)")
+	fs.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "log level: debug, info, warn or error (env LOG_LEVEL)")
+
+	fs.Var((*stringList)(&cfg.CORS.AllowedOrigins), "cors-origins", "comma-separated `origins` allowed to make cross-origin requests (env CORS_ALLOWED_ORIGINS)")
+	fs.BoolVar(&cfg.CORS.AllowCredentials, "cors-credentials", cfg.CORS.AllowCredentials, "let allowed origins send cookies (env CORS_ALLOW_CREDENTIALS)")
+	fs.DurationVar((*time.Duration)(&cfg.CORS.MaxAge), "cors-max-age", time.Duration(cfg.CORS.MaxAge), "how long browsers may cache preflight answers (env CORS_MAX_AGE)")
+	fs.DurationVar((*time.Duration)(&cfg.Security.HSTSMaxAge), "hsts-max-age", time.Duration(cfg.Security.HSTSMaxAge), "Strict-Transport-Security max age; 0 turns it off (env HSTS_MAX_AGE)")
+	fs.BoolVar(&cfg.Session.SecureCookie, "secure-cookie", cfg.Session.SecureCookie, "set the session cookie's Secure attribute (env SESSION_SECURE_COOKIE)")
+	fs.BoolVar(&cfg.Compression.Enabled, "compress", cfg.Compression.Enabled, "compress responses (env COMPRESS)")
+	fs.IntVar(&cfg.Compression.MinSize, "compress-min-size", cfg.Compression.MinSize, "smallest response to compress, in bytes (env COMPRESS_MIN_SIZE)")
+	fs.StringVar(&cfg.Admin.User, "admin-user", cfg.Admin.User, "name of the admin account (env ADMIN_USER)")
+	fs.StringVar((*string)(&cfg.Admin.Password), "admin-password", string(cfg.Admin.Password), "password of the admin account; prefer env ADMIN_PASSWORD, which other users can't see")
+	return fs, path, printOnly
+}
+
+// stringList is a flag.Value for a comma-separated list.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = splitList(v)
+	return nil
+}
+
+// splitList splits a comma-separated list, dropping blanks.
+func splitList(v string) []string {
+	var list []string
+	for item := range strings.SplitSeq(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// loadFile reads a config file over c. Its format goes by the extension;
+// unknown keys are errors, so typos don't go unnoticed.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+	case ".toml":
+		table, err := parseTOML(string(data))
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if data, err = json.Marshal(table); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("config file %s: unknown format; use .json or .toml", path)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("%s: %s", path, strings.TrimPrefix(err.Error(), "json: "))
+	}
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return fmt.Errorf("%s: unexpected data after the configuration", path)
+	}
+	return nil
+}
+
+// applyEnv overrides c with the environment variables that are set.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	var errs []error
+	str := func(name string, dst *string) {
+		if v, ok := lookup(name); ok {
+			*dst = v
+		}
+	}
+	boolean := func(name string, dst *bool) {
+		if v, ok := lookup(name); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not true or false", name, v))
+				return
+			}
+			*dst = b
+		}
+	}
+	integer := func(name string, dst *int) {
+		if v, ok := lookup(name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a whole number", name, v))
+				return
+			}
+			*dst = n
+		}
+	}
+	duration := func(name string, dst *Duration) {
+		if v, ok := lookup(name); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a duration such as \"10s\"", name, v))
+				return
+			}
+			*dst = Duration(d)
+		}
+	}
+
+	if port, ok := lookup("PORT"); ok {
+		c.Server.Addr = ":" + port
+	}
+	duration("READ_TIMEOUT", &c.Server.ReadTimeout)
+	duration("READ_HEADER_TIMEOUT", &c.Server.ReadHeaderTimeout)
+	duration("WRITE_TIMEOUT", &c.Server.WriteTimeout)
+	duration("IDLE_TIMEOUT", &c.Server.IdleTimeout)
+	duration("SHUTDOWN_TIMEOUT", &c.Server.ShutdownTimeout)
+	integer("MAX_HEADER_BYTES", &c.Server.MaxHeaderBytes)
+	str("TLS_CERT_FILE", &c.TLS.CertFile)
+	str("TLS_KEY_FILE", &c.TLS.KeyFile)
+	boolean("TLS_SELF_SIGNED", &c.TLS.SelfSigned)
+	if port, ok := lookup("REDIRECT_PORT"); ok {
+		c.TLS.RedirectAddr = ":" + port
+	}
+	str("LOG_FORMAT", &c.Log.Format)
+	str("LOG_LEVEL", &c.Log.Level)
+	if v, ok := lookup("CORS_ALLOWED_ORIGINS"); ok {
+		c.CORS.AllowedOrigins = splitList(v)
+	}
+	boolean("CORS_ALLOW_CREDENTIALS", &c.CORS.AllowCredentials)
+	duration("CORS_MAX_AGE", &c.CORS.MaxAge)
+	duration("HSTS_MAX_AGE", &c.Security.HSTSMaxAge)
+	boolean("SESSION_SECURE_COOKIE", &c.Session.SecureCookie)
+	boolean("COMPRESS", &c.Compression.Enabled)
+	integer("COMPRESS_MIN_SIZE", &c.Compression.MinSize)
+	str("ADMIN_USER", &c.Admin.User)
+	if v, ok := lookup("ADMIN_PASSWORD"); ok {
+		c.Admin.Password = Secret(v)
+	}
+	return errors.Join(errs...)
+}
+
+// Validate reports every problem with the configuration, one per line,
+// named by the key in the config file.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, key, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: "+format, append([]any{key}, args...)...))
+		}
+	}
+	validAddr := func(key, addr string) {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			check(false, key, "%q is not host:port or :port", addr)
+			return
+		}
+		n, err := strconv.Atoi(port)
+		check(err == nil && n >= 0 && n <= 65535, key, "%q has no valid port", addr)
+	}
+	positive := func(key string, d Duration) {
+		check(d > 0, key, "must be positive, not %s", time.Duration(d))
+	}
+
+	s := c.Server
+	validAddr("server.addr", s.Addr)
+	positive("server.read_timeout", s.ReadTimeout)
+	positive("server.read_header_timeout", s.ReadHeaderTimeout)
+	positive("server.write_timeout", s.WriteTimeout)
+	positive("server.idle_timeout", s.IdleTimeout)
+	positive("server.shutdown_timeout", s.ShutdownTimeout)
+	check(s.ReadHeaderTimeout <= s.ReadTimeout, "server.read_header_timeout", "must not be longer than read_timeout (%s)", time.Duration(s.ReadTimeout))
+	check(s.MaxHeaderBytes >= 1<<10 && s.MaxHeaderBytes <= 1<<20, "server.max_header_bytes", "must be from 1024 to 1048576, not %d", s.MaxHeaderBytes)
+
+	t := c.TLS
+	check((t.CertFile == "") == (t.KeyFile == ""), "tls", "cert_file and key_file must be set together")
+	check(!t.SelfSigned || t.CertFile == "", "tls.self_signed", "can't be combined with cert_file and key_file")
+	if t.RedirectAddr != "" {
+		validAddr("tls.redirect_addr", t.RedirectAddr)
+		check(c.TLSEnabled(), "tls.redirect_addr", "needs HTTPS (cert_file and key_file, or self_signed)")
+		check(t.RedirectAddr != s.Addr, "tls.redirect_addr", "must differ from server.addr")
+	}
+
+	check(c.Log.Format == "text" || c.Log.Format == "json", "log.format", "must be text or json, not %q", c.Log.Format)
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "log.level", "must be debug, info, warn or error, not %q", c.Log.Level)
+
+	if err := c.SecurityPolicy().Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	check(c.Compression.MinSize >= 0, "compression.min_size", "must not be negative")
+	check(c.Admin.User != "", "admin.user", "must not be empty")
+	return errors.Join(errs...)
+}
+
+// TLSEnabled reports whether the server serves HTTPS.
+func (c Config) TLSEnabled() bool {
+	return c.TLS.CertFile != "" || c.TLS.SelfSigned
+}
+
+// SecurityPolicy returns the default policy with the configured CORS and
+// HSTS settings.
+func (c Config) SecurityPolicy() SecurityPolicy {
+	p := DefaultSecurityPolicy()
+	p.CORS.AllowedOrigins = c.CORS.AllowedOrigins
+	p.CORS.AllowCredentials = c.CORS.AllowCredentials
+	p.CORS.MaxAge = time.Duration(c.CORS.MaxAge)
+	p.HSTSMaxAge = time.Duration(c.Security.HSTSMaxAge)
+	return p
+}
+
+// Logger returns a logger writing to stdout in the configured format and
+// from the configured level.
+func (c Config) Logger() *slog.Logger {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.Log.Level))
+	opts := &slog.HandlerOptions{Level: level}
+	if c.Log.Format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stdout, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stdout, opts))
+}
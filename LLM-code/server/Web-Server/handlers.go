@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// App holds the dependencies of the handlers. Handlers are methods on it,
+// so they get their storage, views and sessions injected instead of
+// reaching for globals.
+type App struct {
+	users    UserRepository
+	views    *Views
+	sessions *SessionStore
+	accounts *Accounts
+	logins   *loginLimiter
+}
+
+// NewApp returns an App serving users from the given repository, with
+// logins checked against accounts.
+func NewApp(users UserRepository, views *Views, sessions *SessionStore, accounts *Accounts) *App {
+	return &App{users: users, views: views, sessions: sessions, accounts: accounts, logins: newLoginLimiter()}
+}
+
+// userForm is the create-user form, with the values entered so far and a
+// validation message per field that failed.
+type userForm struct {
+	User      User
+	Errors    map[string]string
+	CSRFToken string
+}
+
+// homeView is the data of the home page.
+type homeView struct {
+	Path  string
+	Form  userForm
+	Table userTable
+}
+
+// csrfToken returns the CSRF token of the request's session, for forms
+// that post without htmx.
+func csrfToken(r *http.Request) string {
+	if s := sessionFrom(r.Context()); s != nil {
+		return s.CSRFToken
+	}
+	return ""
+}
+
+// HomeHandler: the home page, with a form to create a user and the user
+// table, which htmx keeps up to date with partial responses.
+func (a *App) HomeHandler(w http.ResponseWriter, r *http.Request) {
+	a.renderHome(w, r, http.StatusOK, userForm{})
+}
+
+func (a *App) renderHome(w http.ResponseWriter, r *http.Request, status int, form userForm) {
+	userList, err := a.users.List(r.Context())
+	if err != nil {
+		repositoryError(w, r, err)
+		return
+	}
+	form.CSRFToken = csrfToken(r)
+	table := userTable{Users: userList, Editable: currentUser(r) != ""}
+	a.views.Render(w, r, status, "My API Home", "home", homeView{Path: r.URL.Path, Form: form, Table: table})
+}
+
+// HealthHandler: a health check endpoint
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ListUsersHandler: returns the list of all users as JSON, HTML (the user
+// table), CSV or XML, whichever the Accept header prefers
+func (a *App) ListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowedHandler(w)
+		return
+	}
+	media, ok := negotiateUsers(w, r)
+	if !ok {
+		return
+	}
+	userList, err := a.users.List(r.Context())
+	if err != nil {
+		repositoryError(w, r, err)
+		return
+	}
+	// Optionally add caching or ETag headers here.
+	switch media {
+	case mediaHTML:
+		a.views.Render(w, r, http.StatusOK, "Users", "user-table", userTable{Users: userList, Editable: currentUser(r) != ""})
+	case mediaCSV:
+		writeUsersCSV(w, r, http.StatusOK, userList)
+	case mediaXML, mediaTextXML:
+		doc := usersXML{Users: make([]userXML, len(userList))}
+		for i, u := range userList {
+			doc.Users[i] = toUserXML(u)
+		}
+		writeXML(w, r, http.StatusOK, media, doc)
+	default:
+		jsonResponse(w, http.StatusOK, userList)
+	}
+}
+
+// GetUserHandler: returns a single user by ID as JSON, HTML, CSV or XML,
+// whichever the Accept header prefers. htmx gets the user's table row,
+// which is how an inline edit is cancelled.
+func (a *App) GetUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowedHandler(w)
+		return
+	}
+	media, ok := negotiateUsers(w, r)
+	if !ok {
+		return
+	}
+
+	id := r.PathValue("id")
+	user, err := a.users.Get(r.Context(), id)
+	if err != nil {
+		repositoryError(w, r, err)
+		return
+	}
+	switch {
+	case isHTMX(r):
+		a.views.Render(w, r, http.StatusOK, "User "+user.ID, "user-row", newUserRow(user, currentUser(r) != ""))
+	case media == mediaHTML:
+		a.views.Render(w, r, http.StatusOK, "User "+user.ID, "user-detail", user)
+	case media == mediaCSV:
+		writeUsersCSV(w, r, http.StatusOK, []User{user})
+	case media == mediaXML, media == mediaTextXML:
+		writeXML(w, r, http.StatusOK, media, toUserXML(user))
+	default:
+		jsonResponse(w, http.StatusOK, user)
+	}
+}
+
+// EditUserHandler: returns the inline edit row for a user. It only exists
+// for htmx; anyone else is sent to the home page.
+func (a *App) EditUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !isHTMX(r) {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	user, err := a.users.Get(r.Context(), r.PathValue("id"))
+	if err != nil {
+		repositoryError(w, r, err)
+		return
+	}
+	a.views.Render(w, r, http.StatusOK, "Edit user "+user.ID, "user-row-edit", userForm{User: user})
+}
+
+// CreateUserHandler: creates a new user
+// Supports both JSON and form-encoded input. For form submission (like from HTML forms or htmx), we parse form values.
+// htmx gets the form back (empty, or with validation messages), a plain
+// HTML form post gets the home page, and JSON clients get JSON.
+func (a *App) CreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowedHandler(w)
+		return
+	}
+
+	u, isJSON, err := decodeUser(r)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	errs := validateUser(u)
+	if len(errs) == 0 {
+		// Fails with ErrUserExists if the user already exists. JSON
+		// clients get that as a 409; forms show it next to the ID field.
+		err = a.users.Create(r.Context(), u)
+		if errors.Is(err, ErrUserExists) && !isJSON && wantsHTML(r) {
+			errs = map[string]string{"id": "This ID is already taken."}
+		} else if err != nil {
+			repositoryError(w, r, err)
+			return
+		}
+	}
+
+	switch {
+	case isJSON || !wantsHTML(r):
+		if len(errs) > 0 {
+			validationError(w, errs)
+			return
+		}
+		jsonResponse(w, http.StatusCreated, u)
+	case len(errs) > 0 && isHTMX(r):
+		a.views.Render(w, r, http.StatusUnprocessableEntity, "Create user", "user-form", userForm{User: u, Errors: errs, CSRFToken: csrfToken(r)})
+	case len(errs) > 0:
+		a.renderHome(w, r, http.StatusUnprocessableEntity, userForm{User: u, Errors: errs})
+	case isHTMX(r):
+		setTrigger(w, r, "userCreated", map[string]string{"id": u.ID})
+		a.views.Render(w, r, http.StatusCreated, "Create user", "user-form", userForm{CSRFToken: csrfToken(r)})
+	default:
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+// UpdateUserHandler: renames a user. htmx gets the updated table row, or
+// the edit row again with validation messages; JSON clients get JSON.
+func (a *App) UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
+	u, isJSON, err := decodeUser(r)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// The ID comes from the path; users can't be renumbered.
+	u.ID = r.PathValue("id")
+
+	errs := validateUser(u)
+	if len(errs) == 0 {
+		if err := a.users.Update(r.Context(), u); err != nil {
+			repositoryError(w, r, err)
+			return
+		}
+	}
+
+	switch {
+	case isJSON || !isHTMX(r):
+		if len(errs) > 0 {
+			validationError(w, errs)
+			return
+		}
+		jsonResponse(w, http.StatusOK, u)
+	case len(errs) > 0:
+		a.views.Render(w, r, http.StatusUnprocessableEntity, "Edit user "+u.ID, "user-row-edit", userForm{User: u, Errors: errs})
+	default:
+		setTrigger(w, r, "userUpdated", map[string]string{"id": u.ID})
+		a.views.Render(w, r, http.StatusOK, "User "+u.ID, "user-row", newUserRow(u, true))
+	}
+}
+
+// DeleteUserHandler: deletes a user. htmx gets an empty 200 response, so
+// the row it targets is swapped for nothing; others get 204 No Content.
+func (a *App) DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := a.users.Delete(r.Context(), id); err != nil {
+		repositoryError(w, r, err)
+		return
+	}
+	if isHTMX(r) {
+		setTrigger(w, r, "userDeleted", map[string]string{"id": id})
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeUser reads a user from a JSON or form-encoded request body, and
+// reports which of the two it was. Surrounding spaces are trimmed.
+func decodeUser(r *http.Request) (u User, isJSON bool, err error) {
+	ct := r.Header.Get("Content-Type")
+	if strings.HasPrefix(ct, "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			return u, true, errors.New("Invalid JSON")
+		}
+		isJSON = true
+	} else {
+		// Handle form data
+		if err := r.ParseForm(); err != nil {
+			return u, false, errors.New("Unable to parse form")
+		}
+		u.ID = r.Form.Get("id")
+		u.Name = r.Form.Get("name")
+	}
+	u.ID, u.Name = strings.TrimSpace(u.ID), strings.TrimSpace(u.Name)
+	return u, isJSON, nil
+}
+
+// Limits on user fields.
+const (
+	maxUserIDLen   = 64
+	maxUserNameLen = 100
+)
+
+// validateUser checks a user's fields, returning a message per invalid
+// field, keyed by the field's form name. IDs end up in URLs and element
+// IDs, so they are restricted to letters, digits, '-' and '_'.
+func validateUser(u User) map[string]string {
+	errs := make(map[string]string)
+	switch {
+	case u.ID == "":
+		errs["id"] = "ID is required."
+	case len(u.ID) > maxUserIDLen:
+		errs["id"] = "ID must be at most 64 characters."
+	case strings.ContainsFunc(u.ID, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+	}):
+		errs["id"] = "ID may only contain letters, digits, '-' and '_'."
+	}
+	switch {
+	case u.Name == "":
+		errs["name"] = "Name is required."
+	case len(u.Name) > maxUserNameLen:
+		errs["name"] = "Name must be at most 100 characters."
+	}
+	return errs
+}
+
+// validationError writes a 400 JSON error listing the invalid fields.
+func validationError(w http.ResponseWriter, errs map[string]string) {
+	body := map[string]any{"error": "Invalid user", "fields": errs}
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		body["request_id"] = id
+	}
+	jsonResponse(w, http.StatusBadRequest, body)
+}
+
+// wantsHTML reports whether the client would rather have HTML than JSON:
+// htmx, or a browser submitting a plain form.
+func wantsHTML(r *http.Request) bool {
+	if isHTMX(r) {
+		return true
+	}
+	media, _ := negotiate(r, []string{mediaJSON, mediaHTML})
+	return media == mediaHTML
+}
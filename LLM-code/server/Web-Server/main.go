@@ -4,36 +4,62 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"html"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
+	"syscall"
 	"time"
 )
 
-// User is an example data model
-type User struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
-}
-
-// In-memory data store (replace with a database for production)
-var users = map[string]User{
-	"1": {ID: "1", Name: "Alice"},
-	"2": {ID: "2", Name: "Bob"},
-}
-
-// logger is a global structured logger for demonstration.
-// In production, configure properly or inject as dependency.
+// logger is the global structured logger. main replaces it with one in
+// the configured format and level; requests log through loggerFrom.
 var logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
 	Level: slog.LevelInfo,
 }))
 
 func main() {
-	addr := getServerAddress()
+	cfg, printOnly, err := LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if printOnly {
+		fmt.Println(cfg)
+		return
+	}
+	logger = cfg.Logger()
+	addr := cfg.Server.Addr
+
+	views, err := NewViews()
+	if err != nil {
+		logger.Error("Failed to parse templates", "error", err)
+		os.Exit(1)
+	}
+
+	accounts, err := NewAccounts()
+	if err != nil {
+		logger.Error("Failed to set up accounts", "error", err)
+		os.Exit(1)
+	}
+	if err := addAdminAccount(accounts, cfg.Admin); err != nil {
+		logger.Error("Failed to create the admin account", "error", err)
+		os.Exit(1)
+	}
+	// Browsers treat http://localhost as secure, so Secure cookies work
+	// there without TLS.
+	sessions := NewSessionStore(cfg.Session.SecureCookie)
+
+	// In-memory data store (replace with a database for production)
+	app := NewApp(NewMemoryUserRepository(
+		User{ID: "1", Name: "Alice"},
+		User{ID: "2", Name: "Bob"},
+	), views, sessions, accounts)
 
 	mux := http.NewServeMux()
 
@@ -41,24 +67,65 @@ func main() {
 	mux.Handle("/", http.HandlerFunc(notFoundHandler))
 
 	// Register routes with method and path patterns (Go 1.22+)
-	mux.Handle("GET /", http.HandlerFunc(HomeHandler))
-	mux.Handle("GET /users", http.HandlerFunc(ListUsersHandler))
-	mux.Handle("GET /users/{id}", http.HandlerFunc(GetUserHandler))
-	mux.Handle("POST /users", http.HandlerFunc(CreateUserHandler))
+	mux.Handle("GET /", http.HandlerFunc(app.HomeHandler))
+	mux.Handle("GET /users", http.HandlerFunc(app.ListUsersHandler))
+	mux.Handle("GET /users/{id}", http.HandlerFunc(app.GetUserHandler))
+	mux.Handle("GET /users/{id}/edit", RequireLogin(http.HandlerFunc(app.EditUserHandler)))
+	mux.Handle("POST /users", RequireLogin(http.HandlerFunc(app.CreateUserHandler)))
+	mux.Handle("PUT /users/{id}", RequireLogin(http.HandlerFunc(app.UpdateUserHandler)))
+	mux.Handle("DELETE /users/{id}", RequireLogin(http.HandlerFunc(app.DeleteUserHandler)))
+
+	// Login and logout
+	mux.Handle("GET /login", http.HandlerFunc(app.LoginPageHandler))
+	mux.Handle("POST /login", http.HandlerFunc(app.LoginHandler))
+	mux.Handle("POST /logout", http.HandlerFunc(app.LogoutHandler))
+
+	// Prometheus metrics
+	metrics := NewMetrics(mux)
+	mux.Handle("GET /metrics", metrics)
 
 	// Health check endpoint
 	mux.Handle("GET /healthz", http.HandlerFunc(HealthHandler))
 
-	// Wrap mux with middleware: logging, security, etc.
-	handler := LoggingMiddleware(mux)
-	handler = SecurityMiddleware(handler) // Add security headers, CORS, etc.
+	// Wrap mux with middleware: sessions, CSRF checks, panic recovery,
+	// compression, logging, security, metrics, request IDs, etc.
+	handler := CSRFMiddleware(mux)
+	handler = sessions.Middleware(handler)
+	handler = RecoverMiddleware(handler)
+	if cfg.Compression.Enabled {
+		handler = CompressMiddleware(handler, cfg.Compression.MinSize)
+	}
+	handler = LoggingMiddleware(handler)
+	handler = SecurityMiddleware(handler, cfg.SecurityPolicy()) // Add security headers, CORS, etc.
+	handler = metrics.Middleware(handler)
+	handler = RequestIDMiddleware(handler)
+
+	certs, err := getCertStore(cfg.TLS)
+	if err != nil {
+		logger.Error("Failed to load the TLS certificate", "error", err)
+		os.Exit(1)
+	}
 
 	srv := &http.Server{
-		Addr:         addr,
-		Handler:      handler,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		// Adjust IdleTimeout, MaxHeaderBytes, TLS config as needed
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       time.Duration(cfg.Server.ReadTimeout),
+		ReadHeaderTimeout: time.Duration(cfg.Server.ReadHeaderTimeout),
+		WriteTimeout:      time.Duration(cfg.Server.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.Server.IdleTimeout),
+		MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+		HTTP2:             http2Config(),
+	}
+	var redirect *http.Server
+	if certs != nil {
+		srv.TLSConfig = certs.TLSConfig()
+		if cfg.TLS.RedirectAddr != "" {
+			redirect = &http.Server{
+				Addr:              cfg.TLS.RedirectAddr,
+				Handler:           redirectToHTTPS(addr),
+				ReadHeaderTimeout: time.Duration(cfg.Server.ReadHeaderTimeout),
+			}
+		}
 	}
 
 	// Graceful shutdown setup
@@ -66,20 +133,55 @@ func main() {
 	signal.Notify(stop, os.Interrupt)
 
 	go func() {
-		logger.Info("Server starting", "addr", addr)
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		var err error
+		if certs != nil {
+			logger.Info("Server starting", "addr", addr, "tls", true, "cert_expires", certs.Expires())
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			logger.Info("Server starting", "addr", addr)
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			logger.Error("ListenAndServe error", "error", err)
 			os.Exit(1)
 		}
 	}()
+	if redirect != nil {
+		go func() {
+			logger.Info("Redirecting HTTP to HTTPS", "addr", redirect.Addr)
+			if err := redirect.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("Redirect listener error", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	// Reload the certificate on SIGHUP, e.g. after it was renewed.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if certs == nil {
+				continue
+			}
+			if err := certs.Reload(); err != nil {
+				logger.Error("Failed to reload the TLS certificate; keeping the current one", "error", err)
+				continue
+			}
+			logger.Info("Reloaded the TLS certificate", "cert_expires", certs.Expires())
+		}
+	}()
 
 	// Wait for interrupt signal for graceful shutdown
 	<-stop
 	logger.Info("Shutting down server...")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Server.ShutdownTimeout))
 	defer cancel()
 
+	if redirect != nil {
+		redirect.Shutdown(ctx)
+	}
 	// Finish any ongoing requests
 	if err := srv.Shutdown(ctx); err != nil {
 		logger.Error("Server shutdown error", "error", err)
@@ -88,105 +190,6 @@ func main() {
 	}
 }
 
-// HomeHandler: a simple handler for the home page
-// Demonstrates a basic HTML page that can integrate with htmx for dynamic updates.
-func HomeHandler(w http.ResponseWriter, r *http.Request) {
-	// Example: if the request is from htmx (hx-boost, hx-get, hx-post),
-	// we could return partial HTML. Otherwise, return full HTML.
-
-	// For now, just return a simple page with a form to create a new user.
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	fmt.Fprintf(w, `<!DOCTYPE html>
-<html>
-<head><title>My API Home</title></head>
-<body>
-<h1>Welcome to my API!</h1>
-<p>Your path: %q</p>
-<form id="create-user-form" hx-post="/users" hx-target="#result" hx-swap="afterend">
-  <input type="text" name="id" placeholder="User ID" required>
-  <input type="text" name="name" placeholder="User Name" required>
-  <button type="submit">Create User</button>
-</form>
-<div id="result"></div>
-</body>
-</html>`, html.EscapeString(r.URL.Path))
-}
-
-// HealthHandler: a health check endpoint
-func HealthHandler(w http.ResponseWriter, r *http.Request) {
-	jsonResponse(w, http.StatusOK, map[string]string{"status": "ok"})
-}
-
-// ListUsersHandler: returns the list of all users
-func ListUsersHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		methodNotAllowedHandler(w)
-		return
-	}
-	userList := make([]User, 0, len(users))
-	for _, u := range users {
-		userList = append(userList, u)
-	}
-	// Optionally add caching or ETag headers here.
-	jsonResponse(w, http.StatusOK, userList)
-}
-
-// GetUserHandler: returns a single user by ID
-func GetUserHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		methodNotAllowedHandler(w)
-		return
-	}
-
-	id := r.PathValue("id")
-	user, ok := users[id]
-	if !ok {
-		jsonError(w, http.StatusNotFound, "User not found")
-		return
-	}
-	jsonResponse(w, http.StatusOK, user)
-}
-
-// CreateUserHandler: creates a new user
-// Supports both JSON and form-encoded input. For form submission (like from HTML forms or htmx), we parse form values.
-func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		methodNotAllowedHandler(w)
-		return
-	}
-
-	var u User
-	ct := r.Header.Get("Content-Type")
-	if strings.HasPrefix(ct, "application/json") {
-		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
-			jsonError(w, http.StatusBadRequest, "Invalid JSON")
-			return
-		}
-	} else {
-		// Handle form data
-		if err := r.ParseForm(); err != nil {
-			jsonError(w, http.StatusBadRequest, "Unable to parse form")
-			return
-		}
-		u.ID = r.Form.Get("id")
-		u.Name = r.Form.Get("name")
-	}
-
-	if u.ID == "" || u.Name == "" {
-		jsonError(w, http.StatusBadRequest, "Missing fields: both 'id' and 'name' required")
-		return
-	}
-
-	// Check if user already exists
-	if _, exists := users[u.ID]; exists {
-		jsonError(w, http.StatusConflict, "User ID already exists")
-		return
-	}
-
-	users[u.ID] = u
-	jsonResponse(w, http.StatusCreated, u)
-}
-
 // notFoundHandler: custom handler for 404 Not Found
 func notFoundHandler(w http.ResponseWriter, r *http.Request) {
 	jsonError(w, http.StatusNotFound, "Not found")
@@ -201,10 +204,10 @@ func methodNotAllowedHandler(w http.ResponseWriter) {
 func LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		rr := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
-		next.ServeHTTP(rr, r)
+		rr := newResponseRecorder(w)
+		next.ServeHTTP(exposeLike(rr, w), r)
 		duration := time.Since(start)
-		logger.Info("request",
+		loggerFrom(r.Context()).Info("request",
 			"method", r.Method,
 			"path", r.URL.Path,
 			"status", rr.statusCode,
@@ -214,60 +217,68 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// SecurityMiddleware: adds basic security headers and CORS policies.
-// Customize as needed for production security requirements.
-func SecurityMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Basic security headers
-		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.Header().Set("X-Frame-Options", "DENY")
-		w.Header().Set("X-XSS-Protection", "1; mode=block")
-
-		// CORS example (adjust as needed)
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		if r.Method == http.MethodOptions {
-			w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE,OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
-
 // jsonResponse is a helper function to send JSON responses with status codes
 func jsonResponse(w http.ResponseWriter, status int, data any) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(status)
 	if data != nil {
 		if err := json.NewEncoder(w).Encode(data); err != nil {
-			logger.Error("Failed to encode JSON response", "error", err)
+			logger.Error("Failed to encode JSON response", "error", err, "request_id", w.Header().Get(requestIDHeader))
 		}
 	}
 }
 
-// jsonError writes a JSON error message with a given status code
+// jsonError writes a JSON error message with a given status code, and the
+// request ID to quote when reporting it
 func jsonError(w http.ResponseWriter, status int, message string) {
-	jsonResponse(w, status, map[string]string{"error": message})
+	body := map[string]string{"error": message}
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		body["request_id"] = id
+	}
+	jsonResponse(w, status, body)
 }
 
-// getServerAddress returns the server address from PORT env var or default ":8080"
-func getServerAddress() string {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+// repositoryError maps an error from the UserRepository to a JSON error
+// response.
+func repositoryError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		jsonError(w, http.StatusNotFound, "User not found")
+	case errors.Is(err, ErrUserExists):
+		jsonError(w, http.StatusConflict, "User ID already exists")
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		jsonError(w, http.StatusServiceUnavailable, "Request cancelled")
+	default:
+		loggerFrom(r.Context()).Error("User repository error", "error", err)
+		jsonError(w, http.StatusInternalServerError, "Internal server error")
 	}
-	return ":" + port
 }
 
-// responseRecorder is used in LoggingMiddleware to capture the status code
-type responseRecorder struct {
-	http.ResponseWriter
-	statusCode int
+// addAdminAccount creates the account to log in with. Without a
+// configured password, one is generated for trying the server out, but
+// only when started from a terminal: it is printed to stderr, not logged,
+// so it doesn't end up with the logs. Otherwise a password is required.
+func addAdminAccount(accounts *Accounts, admin AdminConfig) error {
+	password := string(admin.Password)
+	if password == "" {
+		if fi, err := os.Stderr.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+			return errors.New("ADMIN_PASSWORD is not set (a password is only generated for interactive starts)")
+		}
+		password = randomToken()[:16]
+		fmt.Fprintf(os.Stderr, "ADMIN_PASSWORD not set; log in as %q with the generated password %s\n", admin.User, password)
+	}
+	return accounts.Add(admin.User, password)
 }
 
-func (rr *responseRecorder) WriteHeader(code int) {
-	rr.statusCode = code
-	rr.ResponseWriter.WriteHeader(code)
+// getCertStore returns the configured TLS certificate: read from files,
+// generated if self-signed, or nil to serve plain HTTP.
+func getCertStore(cfg TLSConfig) (*certStore, error) {
+	switch {
+	case cfg.CertFile != "":
+		return loadCertStore(cfg.CertFile, cfg.KeyFile)
+	case cfg.SelfSigned:
+		logger.Warn("Using a self-signed certificate; only for local development")
+		return selfSignedCertStore()
+	}
+	return nil, nil
 }
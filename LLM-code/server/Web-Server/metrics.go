@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Histogram buckets: request durations in seconds, response sizes in bytes.
+var (
+	durationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	sizeBuckets     = []float64{100, 1_000, 10_000, 100_000, 1_000_000, 10_000_000}
+)
+
+// histogram counts observations per bucket; counts[i] is for values up to
+// buckets[i], and the last entry for those above every bucket.
+type histogram struct {
+	counts []uint64
+	sum    float64
+}
+
+func newHistogram(buckets []float64) histogram {
+	return histogram{counts: make([]uint64, len(buckets)+1)}
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	i, _ := slices.BinarySearch(buckets, v)
+	h.counts[i]++
+	h.sum += v
+}
+
+// routeKey identifies a series: the route pattern and the status class.
+type routeKey struct {
+	route, class string
+}
+
+type routeStats struct {
+	requests uint64
+	duration histogram
+	size     histogram
+}
+
+// Metrics collects request metrics and serves them, with Go runtime
+// stats, in the Prometheus text format. It is safe for concurrent use.
+type Metrics struct {
+	mux      *http.ServeMux
+	started  time.Time
+	inFlight atomic.Int64
+
+	mu     sync.Mutex
+	routes map[routeKey]*routeStats
+}
+
+// NewMetrics returns a collector that labels requests with the route
+// patterns of mux.
+func NewMetrics(mux *http.ServeMux) *Metrics {
+	return &Metrics{mux: mux, started: time.Now(), routes: make(map[routeKey]*routeStats)}
+}
+
+// Middleware records every request: count and duration by route and
+// status class, response size, and how many are in flight. The route is
+// the pattern mux will match (what the handler gets as r.Pattern), worked
+// out up front because middleware further in replaces the request.
+// Requests no route matches are labelled "unmatched".
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.inFlight.Add(1)
+		defer m.inFlight.Add(-1)
+
+		_, route := m.mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		start := time.Now()
+		rr := newResponseRecorder(w)
+		next.ServeHTTP(exposeLike(rr, w), r)
+		m.observe(routeKey{route, strconv.Itoa(rr.statusCode/100) + "xx"}, time.Since(start), rr.bytes)
+	})
+}
+
+func (m *Metrics) observe(key routeKey, d time.Duration, size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.routes[key]
+	if !ok {
+		s = &routeStats{duration: newHistogram(durationBuckets), size: newHistogram(sizeBuckets)}
+		m.routes[key] = s
+	}
+	s.requests++
+	s.duration.observe(durationBuckets, d.Seconds())
+	s.size.observe(sizeBuckets, float64(size))
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	keys := make([]routeKey, 0, len(m.routes))
+	stats := make(map[routeKey]routeStats, len(m.routes))
+	for k, s := range m.routes {
+		keys = append(keys, k)
+		c := *s
+		c.duration.counts = slices.Clone(s.duration.counts)
+		c.size.counts = slices.Clone(s.size.counts)
+		stats[k] = c
+	}
+	m.mu.Unlock()
+	slices.SortFunc(keys, func(a, b routeKey) int {
+		return cmp.Or(strings.Compare(a.route, b.route), strings.Compare(a.class, b.class))
+	})
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	header(out, "http_requests_total", "counter", "Requests handled, by route pattern and status class.")
+	for _, k := range keys {
+		fmt.Fprintf(out, "http_requests_total{%s} %d\n", k.labels(), stats[k].requests)
+	}
+	header(out, "http_request_duration_seconds", "histogram", "Time taken to handle requests, by route pattern and status class.")
+	for _, k := range keys {
+		s := stats[k]
+		writeHistogram(out, "http_request_duration_seconds", k.labels(), durationBuckets, s.duration, s.requests)
+	}
+	header(out, "http_response_size_bytes", "histogram", "Size of response bodies as sent, by route pattern and status class.")
+	for _, k := range keys {
+		s := stats[k]
+		writeHistogram(out, "http_response_size_bytes", k.labels(), sizeBuckets, s.size, s.requests)
+	}
+	header(out, "http_requests_in_flight", "gauge", "Requests being handled.")
+	fmt.Fprintf(out, "http_requests_in_flight %d\n", m.inFlight.Load())
+
+	header(out, "go_info", "gauge", "Go version the server was built with.")
+	fmt.Fprintf(out, "go_info{version=%q} 1\n", runtime.Version())
+	header(out, "go_goroutines", "gauge", "Goroutines that currently exist.")
+	fmt.Fprintf(out, "go_goroutines %d\n", runtime.NumGoroutine())
+	header(out, "go_memstats_alloc_bytes", "gauge", "Bytes of allocated heap objects.")
+	fmt.Fprintf(out, "go_memstats_alloc_bytes %d\n", mem.HeapAlloc)
+	header(out, "go_memstats_alloc_bytes_total", "counter", "Bytes allocated for heap objects, including freed ones.")
+	fmt.Fprintf(out, "go_memstats_alloc_bytes_total %d\n", mem.TotalAlloc)
+	header(out, "go_memstats_heap_objects", "gauge", "Allocated heap objects.")
+	fmt.Fprintf(out, "go_memstats_heap_objects %d\n", mem.HeapObjects)
+	header(out, "go_memstats_sys_bytes", "gauge", "Bytes of memory obtained from the OS.")
+	fmt.Fprintf(out, "go_memstats_sys_bytes %d\n", mem.Sys)
+	header(out, "go_gc_cycles_total", "counter", "Completed GC cycles.")
+	fmt.Fprintf(out, "go_gc_cycles_total %d\n", mem.NumGC)
+	header(out, "go_gc_pause_seconds_total", "counter", "Time spent in GC stop-the-world pauses.")
+	fmt.Fprintf(out, "go_gc_pause_seconds_total %s\n", formatFloat(float64(mem.PauseTotalNs)/1e9))
+	header(out, "process_start_time_seconds", "gauge", "Start time of the process since the Unix epoch.")
+	fmt.Fprintf(out, "process_start_time_seconds %d\n", m.started.Unix())
+}
+
+func header(out *bufio.Writer, name, typ, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeHistogram writes a histogram's cumulative buckets, sum and count.
+func writeHistogram(out *bufio.Writer, name, labels string, buckets []float64, h histogram, count uint64) {
+	var cumulative uint64
+	for i, le := range buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(out, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, formatFloat(le), cumulative)
+	}
+	fmt.Fprintf(out, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, count)
+	fmt.Fprintf(out, "%s_sum{%s} %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(out, "%s_count{%s} %d\n", name, labels, count)
+}
+
+func (k routeKey) labels() string {
+	return `route="` + escapeLabel(k.route) + `",code="` + k.class + `"`
+}
+
+// escapeLabel escapes a label value as the text format requires.
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
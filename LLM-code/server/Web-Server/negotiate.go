@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Media types the /users endpoints can produce. Where the client likes
+// several equally, the earlier one in userMediaTypes wins.
+const (
+	mediaJSON    = "application/json"
+	mediaHTML    = "text/html"
+	mediaCSV     = "text/csv"
+	mediaXML     = "application/xml"
+	mediaTextXML = "text/xml"
+)
+
+var userMediaTypes = []string{mediaJSON, mediaHTML, mediaCSV, mediaXML, mediaTextXML}
+
+// acceptRange is one media range of an Accept header, e.g. "text/*;q=0.5".
+type acceptRange struct {
+	typ, subtype string
+	q            float64
+}
+
+// parseAccept parses an Accept header. Ranges that don't parse, or whose
+// q is not a number from 0 to 1, are left out.
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for part := range strings.SplitSeq(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		typ, subtype, ok := strings.Cut(mediaType, "/")
+		if !ok || typ == "*" && subtype != "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, acceptRange{typ: typ, subtype: subtype, q: q})
+	}
+	return ranges
+}
+
+// negotiate picks the offer the request's Accept header prefers (RFC 9110,
+// section 12.5.1): each offer gets the q of the most specific range that
+// matches it, and the offer with the highest q above 0 wins, ties going to
+// the earlier offer. Without an Accept header the first offer wins. ok is
+// false if the client accepts none of the offers.
+func negotiate(r *http.Request, offers []string) (media string, ok bool) {
+	header := r.Header.Values("Accept")
+	if len(header) == 0 {
+		return offers[0], true
+	}
+	ranges := parseAccept(strings.Join(header, ","))
+	bestQ := 0.0
+	for _, offer := range offers {
+		typ, subtype, _ := strings.Cut(offer, "/")
+		q, specificity := 0.0, 0
+		for _, ar := range ranges {
+			s := 0
+			switch {
+			case ar.typ == typ && ar.subtype == subtype:
+				s = 3
+			case ar.typ == typ && ar.subtype == "*":
+				s = 2
+			case ar.typ == "*":
+				s = 1
+			}
+			if s > specificity {
+				q, specificity = ar.q, s
+			}
+		}
+		if q > bestQ {
+			media, bestQ = offer, q
+		}
+	}
+	return media, bestQ > 0
+}
+
+// negotiateUsers picks the representation for a /users response, or
+// answers 406 Not Acceptable and returns ok == false. htmx requests always
+// get HTML fragments. Responses vary with both headers, which caches are
+// told with Vary.
+func negotiateUsers(w http.ResponseWriter, r *http.Request) (media string, ok bool) {
+	w.Header().Add("Vary", "Accept")
+	w.Header().Add("Vary", "HX-Request")
+	if isHTMX(r) {
+		return mediaHTML, true
+	}
+	media, ok = negotiate(r, userMediaTypes)
+	if !ok {
+		jsonError(w, http.StatusNotAcceptable, "Not acceptable; available types: "+strings.Join(userMediaTypes, ", "))
+	}
+	return media, ok
+}
+
+// writeUsersCSV writes users as CSV with a header row.
+func writeUsersCSV(w http.ResponseWriter, r *http.Request, status int, users []User) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.WriteHeader(status)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "name"})
+	for _, u := range users {
+		cw.Write([]string{csvCell(u.ID), csvCell(u.Name)})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		loggerFrom(r.Context()).Error("Failed to write CSV response", "error", err)
+	}
+}
+
+// csvCell defuses values that spreadsheets would run as formulas by
+// prefixing them with a quote.
+func csvCell(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+// userXML is how a user is written as XML: <user id="1"><name>Alice</name></user>.
+type userXML struct {
+	XMLName xml.Name `xml:"user"`
+	ID      string   `xml:"id,attr"`
+	Name    string   `xml:"name"`
+}
+
+// usersXML is the XML document for a list of users.
+type usersXML struct {
+	XMLName xml.Name  `xml:"users"`
+	Users   []userXML `xml:"user"`
+}
+
+// writeXML writes v as an XML document with the given content type.
+func writeXML(w http.ResponseWriter, r *http.Request, status int, contentType string, v any) {
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		loggerFrom(r.Context()).Error("Failed to encode XML response", "error", err)
+	}
+	w.Write([]byte("\n"))
+}
+
+func toUserXML(u User) userXML {
+	return userXML{ID: u.ID, Name: u.Name}
+}
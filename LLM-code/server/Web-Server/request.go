@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// requestIDHeader carries the request ID. A well-formed ID sent by a proxy
+// or client is kept, so one ID follows the request across services; the
+// response always echoes it.
+const (
+	requestIDHeader   = "X-Request-ID"
+	maxRequestIDBytes = 128
+)
+
+// newRequestID returns 16 random bytes, hex-encoded.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether an incoming ID is safe to reuse: short,
+// printable ASCII without spaces, so it can't forge log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDBytes {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFrom returns the request's ID, or "" outside RequestIDMiddleware.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// loggerFrom returns the request's logger, which adds the request ID to
+// every line, or the global logger outside RequestIDMiddleware.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return l
+	}
+	return logger
+}
+
+// RequestIDMiddleware gives each request an ID, sets it on the response
+// before anything else is written (jsonError puts it in error bodies), and
+// puts the ID and a logger carrying it in the request context. It should be
+// the outermost middleware.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		ctx = context.WithValue(ctx, loggerKey, logger.With("request_id", id))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RecoverMiddleware turns a panic in a handler into a 500 JSON error and
+// logs it with its stack trace. If the response had already started, the
+// connection is aborted instead, so the client can't mistake a truncated
+// response for a whole one.
+func RecoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rr := newResponseRecorder(w)
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// Deliberate abort; net/http handles it quietly.
+				panic(v)
+			}
+			loggerFrom(r.Context()).Error("Panic in handler",
+				"panic", fmt.Sprint(v),
+				"method", r.Method,
+				"path", r.URL.Path,
+				"stack", string(debug.Stack()),
+			)
+			if rr.wroteHeader {
+				panic(http.ErrAbortHandler)
+			}
+			// Don't fire htmx events for work that didn't finish.
+			rr.Header().Del("HX-Trigger")
+			rr.Header().Del("HX-Redirect")
+			jsonError(rr, http.StatusInternalServerError, "Internal server error")
+		}()
+		next.ServeHTTP(exposeLike(rr, w), r)
+	})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SecurityPolicy says which security headers SecurityMiddleware sets and
+// which cross-origin requests it allows.
+type SecurityPolicy struct {
+	// ContentSecurityPolicy lists the CSP directives. "{nonce}" in a
+	// directive is replaced by the request's nonce source ('nonce-…'),
+	// which templates put on their inline <script> and <style> elements.
+	ContentSecurityPolicy []string
+	// HSTSMaxAge is how long browsers should insist on HTTPS. The header
+	// is only sent over TLS; 0 turns it off.
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+	ReferrerPolicy        string
+	PermissionsPolicy     string
+	CORS                  CORSPolicy
+}
+
+// CORSPolicy says which other origins may call the server from a browser.
+// With no AllowedOrigins only same-origin requests work.
+type CORSPolicy struct {
+	// AllowedOrigins are exact origins such as "https://app.example.com",
+	// or "*" for any origin (which rules out AllowCredentials).
+	AllowedOrigins []string
+	// AllowCredentials lets allowed origins send cookies. They still need
+	// the session's CSRF token for state-changing requests.
+	AllowCredentials bool
+	// AllowedMethods and AllowedHeaders are what a preflight may ask for.
+	AllowedMethods []string
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers scripts may read.
+	ExposedHeaders []string
+	// MaxAge is how long browsers may cache a preflight answer.
+	MaxAge time.Duration
+}
+
+// htmxScript is the one file the pages load from a CDN. The layout
+// template loads it with a Subresource Integrity hash, so a changed file is
+// refused; update both together.
+const htmxScript = "https://unpkg.com/htmx.org@2.0.4/dist/htmx.min.js"
+
+// DefaultSecurityPolicy allows scripts only from this server, the pinned
+// htmx file and nonce-carrying inline elements, and no cross-origin
+// requests.
+func DefaultSecurityPolicy() SecurityPolicy {
+	return SecurityPolicy{
+		ContentSecurityPolicy: []string{
+			"default-src 'self'",
+			"script-src 'self' " + htmxScript + " {nonce}",
+			"style-src 'self' {nonce}",
+			"img-src 'self' data:",
+			"object-src 'none'",
+			"base-uri 'self'",
+			"form-action 'self'",
+			"frame-ancestors 'none'",
+		},
+		HSTSMaxAge:            365 * 24 * time.Hour,
+		HSTSIncludeSubdomains: true,
+		ReferrerPolicy:        "strict-origin-when-cross-origin",
+		PermissionsPolicy:     "camera=(), microphone=(), geolocation=(), payment=(), usb=()",
+		CORS: CORSPolicy{
+			AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+			AllowedHeaders: []string{"Content-Type", "Accept", csrfHeader, "HX-Request", "HX-Target", "HX-Trigger", "HX-Current-URL"},
+			ExposedHeaders: []string{"HX-Trigger", "HX-Redirect"},
+			MaxAge:         10 * time.Minute,
+		},
+	}
+}
+
+// Validate reports the first inconsistency in the policy.
+func (p SecurityPolicy) Validate() error {
+	c := p.CORS
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			if c.AllowCredentials {
+				return errors.New("CORS: the \"*\" origin can't be combined with credentials")
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return fmt.Errorf("CORS: origin %q is not of the form scheme://host[:port]", origin)
+		}
+	}
+	if c.MaxAge < 0 {
+		return errors.New("CORS: max age must not be negative")
+	}
+	if p.HSTSMaxAge < 0 {
+		return errors.New("HSTS: max age must not be negative")
+	}
+	return nil
+}
+
+// cspNonce returns the request's CSP nonce, or "" outside
+// SecurityMiddleware.
+func cspNonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(cspNonceKey).(string)
+	return nonce
+}
+
+// SecurityMiddleware: adds security headers and applies the CORS policy.
+// Preflight requests are answered here and don't reach next.
+func SecurityMiddleware(next http.Handler, p SecurityPolicy) http.Handler {
+	csp := strings.Join(p.ContentSecurityPolicy, "; ")
+	hsts := ""
+	if p.HSTSMaxAge > 0 {
+		hsts = "max-age=" + strconv.Itoa(int(p.HSTSMaxAge.Seconds()))
+		if p.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if p.HSTSPreload {
+			hsts += "; preload"
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		if csp != "" {
+			b := make([]byte, 16)
+			rand.Read(b)
+			nonce := base64.RawURLEncoding.EncodeToString(b)
+			h.Set("Content-Security-Policy", strings.ReplaceAll(csp, "{nonce}", "'nonce-"+nonce+"'"))
+			r = r.WithContext(context.WithValue(r.Context(), cspNonceKey, nonce))
+		}
+		if hsts != "" && r.TLS != nil {
+			h.Set("Strict-Transport-Security", hsts)
+		}
+		if p.ReferrerPolicy != "" {
+			h.Set("Referrer-Policy", p.ReferrerPolicy)
+		}
+		if p.PermissionsPolicy != "" {
+			h.Set("Permissions-Policy", p.PermissionsPolicy)
+		}
+
+		if p.CORS.handle(w, r) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handle applies the CORS policy to a request, and reports whether it was
+// a preflight request, which it has answered.
+func (c CORSPolicy) handle(w http.ResponseWriter, r *http.Request) bool {
+	h := w.Header()
+	// Whether the CORS headers are set depends on Origin, so caches must
+	// keep responses to different origins apart.
+	h.Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	if preflight {
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+	}
+	if origin == "" {
+		return false
+	}
+	allowed := c.allowOrigin(origin)
+	if !allowed {
+		if preflight {
+			jsonError(w, http.StatusForbidden, "Origin not allowed")
+			return true
+		}
+		// Same-origin requests carry Origin too; the browser enforces the
+		// missing CORS headers for cross-origin ones.
+		return false
+	}
+
+	if slices.Contains(c.AllowedOrigins, "*") && !c.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		if len(c.ExposedHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+		}
+		return false
+	}
+
+	method := r.Header.Get("Access-Control-Request-Method")
+	if !slices.Contains(c.AllowedMethods, method) {
+		jsonError(w, http.StatusForbidden, "Method not allowed by CORS policy: "+method)
+		return true
+	}
+	var requested []string
+	for _, name := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !slices.ContainsFunc(c.AllowedHeaders, func(a string) bool { return strings.EqualFold(a, name) }) {
+			jsonError(w, http.StatusForbidden, "Header not allowed by CORS policy: "+name)
+			return true
+		}
+		requested = append(requested, name)
+	}
+	h.Set("Access-Control-Allow-Methods", method)
+	if len(requested) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+	}
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// allowOrigin reports whether origin is on the allow-list.
+func (c CORSPolicy) allowOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
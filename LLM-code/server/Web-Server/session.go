@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Sessions are kept on the server; the browser only holds a random session
+// ID in a Secure, HttpOnly, SameSite=Lax cookie. A session ends after
+// sessionIdleTimeout without requests or sessionMaxAge after it started,
+// whichever comes first. Its ID is replaced on login and every
+// sessionRotateEvery while in use, so a leaked ID soon stops working.
+//
+// Every session carries a CSRF token, which state-changing requests must
+// send back in the X-CSRF-Token header (htmx does so for every request; see
+// the layout template) or the csrf_token form field (plain HTML forms).
+const (
+	sessionCookieName  = "session"
+	sessionIdleTimeout = 30 * time.Minute
+	sessionMaxAge      = 12 * time.Hour
+	sessionRotateEvery = 15 * time.Minute
+	// sessionRotateGrace is how long a replaced ID keeps working, for
+	// requests that were already on their way with it.
+	sessionRotateGrace = 30 * time.Second
+	// maxAnonymousSessions caps the sessions started for visitors who are
+	// not logged in, which anyone can create by fetching the login page.
+	// Beyond it the least recently used one is dropped.
+	maxAnonymousSessions = 10_000
+	csrfHeader           = "X-CSRF-Token"
+	csrfFormField        = "csrf_token"
+)
+
+// Session is a visitor's server-side session. Anonymous visitors get one
+// too, as soon as they are shown a form, to hold the form's CSRF token.
+type Session struct {
+	Username  string // empty until logged in
+	CSRFToken string
+	Created   time.Time
+
+	// Guarded by the store's mutex.
+	id        string
+	lastSeen  time.Time
+	rotatedAt time.Time
+}
+
+// SessionStore keeps sessions in memory and issues their cookies.
+type SessionStore struct {
+	secure bool // set the cookie's Secure attribute
+
+	mu        sync.Mutex
+	sessions  map[string]*Session
+	retired   map[string]time.Time // replaced IDs -> end of their grace period
+	anonymous map[*Session]struct{}
+	swept     time.Time
+}
+
+// NewSessionStore returns an empty store. secure should only be false when
+// the site is served over plain HTTP from somewhere other than localhost,
+// which browsers would otherwise refuse to set the cookie for.
+func NewSessionStore(secure bool) *SessionStore {
+	return &SessionStore{
+		secure:    secure,
+		sessions:  make(map[string]*Session),
+		retired:   make(map[string]time.Time),
+		anonymous: make(map[*Session]struct{}),
+	}
+}
+
+// randomToken returns 32 random bytes, base64url-encoded.
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+type contextKey int
+
+const (
+	sessionKey contextKey = iota
+	cspNonceKey
+	requestIDKey
+	loggerKey
+)
+
+// sessionFrom returns the request's session, or nil if it has none.
+func sessionFrom(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey).(*Session)
+	return s
+}
+
+// currentUser returns the logged-in user's name, or "" if not logged in.
+func currentUser(r *http.Request) string {
+	if s := sessionFrom(r.Context()); s != nil {
+		return s.Username
+	}
+	return ""
+}
+
+// Middleware loads the session named by the request's cookie into the
+// request context, rotating its ID when due.
+func (st *SessionStore) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie(sessionCookieName); err == nil {
+			if s := st.lookup(c.Value); s != nil {
+				if id, rotated := st.rotateIfDue(s); rotated {
+					st.setCookie(w, id, s.Created)
+				}
+				r = r.WithContext(context.WithValue(r.Context(), sessionKey, s))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// lookup returns the live session with the given ID and marks it as used.
+func (st *SessionStore) lookup(id string) *Session {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, ok := st.sessions[id]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if grace, retired := st.retired[id]; retired && now.After(grace) {
+		delete(st.sessions, id)
+		delete(st.retired, id)
+		return nil
+	}
+	if now.Sub(s.lastSeen) > sessionIdleTimeout || now.Sub(s.Created) > sessionMaxAge {
+		st.deleteLocked(s)
+		return nil
+	}
+	s.lastSeen = now
+	return s
+}
+
+// Ensure returns the request's session, starting an anonymous one (and
+// setting its cookie) if there is none. Handlers that render a form call
+// it to have a CSRF token to put in the form.
+func (st *SessionStore) Ensure(w http.ResponseWriter, r *http.Request) (*Session, *http.Request) {
+	if s := sessionFrom(r.Context()); s != nil {
+		return s, r
+	}
+	s := st.start("")
+	st.setCookie(w, s.id, s.Created)
+	return s, r.WithContext(context.WithValue(r.Context(), sessionKey, s))
+}
+
+// Login starts a new session for username in place of the request's
+// current one, so that an ID planted before login (session fixation) is
+// worthless afterwards. The CSRF token is replaced too.
+func (st *SessionStore) Login(w http.ResponseWriter, r *http.Request, username string) *Session {
+	if old := sessionFrom(r.Context()); old != nil {
+		st.mu.Lock()
+		st.deleteLocked(old)
+		st.mu.Unlock()
+	}
+	s := st.start(username)
+	st.setCookie(w, s.id, s.Created)
+	return s
+}
+
+// Logout ends the request's session and clears the cookie.
+func (st *SessionStore) Logout(w http.ResponseWriter, r *http.Request) {
+	if s := sessionFrom(r.Context()); s != nil {
+		st.mu.Lock()
+		st.deleteLocked(s)
+		st.mu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   st.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (st *SessionStore) start(username string) *Session {
+	now := time.Now()
+	s := &Session{
+		Username:  username,
+		CSRFToken: randomToken(),
+		Created:   now,
+		id:        randomToken(),
+		lastSeen:  now,
+		rotatedAt: now,
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sweepLocked(now)
+	if username == "" {
+		if len(st.anonymous) >= maxAnonymousSessions {
+			st.evictAnonymousLocked()
+		}
+		st.anonymous[s] = struct{}{}
+	}
+	st.sessions[s.id] = s
+	return s
+}
+
+// evictAnonymousLocked drops the anonymous session used least recently.
+// Callers must hold st.mu.
+func (st *SessionStore) evictAnonymousLocked() {
+	var oldest *Session
+	for s := range st.anonymous {
+		if oldest == nil || s.lastSeen.Before(oldest.lastSeen) {
+			oldest = s
+		}
+	}
+	if oldest != nil {
+		st.deleteLocked(oldest)
+	}
+}
+
+// rotateIfDue gives s a new ID if it has had its current one for
+// sessionRotateEvery, and returns the new ID. The old ID keeps working for
+// sessionRotateGrace.
+func (st *SessionStore) rotateIfDue(s *Session) (id string, rotated bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.rotatedAt) < sessionRotateEvery {
+		return "", false
+	}
+	st.retired[s.id] = now.Add(sessionRotateGrace)
+	s.id = randomToken()
+	s.rotatedAt = now
+	st.sessions[s.id] = s
+	return s.id, true
+}
+
+// deleteLocked removes s under all its IDs. Callers must hold st.mu.
+func (st *SessionStore) deleteLocked(s *Session) {
+	for id, other := range st.sessions {
+		if other == s {
+			delete(st.sessions, id)
+			delete(st.retired, id)
+		}
+	}
+	delete(st.anonymous, s)
+}
+
+// sweepLocked drops expired sessions, at most once a minute. Callers must
+// hold st.mu.
+func (st *SessionStore) sweepLocked(now time.Time) {
+	if now.Sub(st.swept) < time.Minute {
+		return
+	}
+	st.swept = now
+	for id, s := range st.sessions {
+		grace, retired := st.retired[id]
+		expired := now.Sub(s.lastSeen) > sessionIdleTimeout || now.Sub(s.Created) > sessionMaxAge
+		if retired && now.After(grace) || expired {
+			delete(st.sessions, id)
+			delete(st.retired, id)
+		}
+		if expired {
+			delete(st.anonymous, s)
+		}
+	}
+}
+
+// setCookie sets the session cookie to id, expiring when a session created
+// at created reaches sessionMaxAge.
+func (st *SessionStore) setCookie(w http.ResponseWriter, id string, created time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(time.Until(created.Add(sessionMaxAge)).Seconds()),
+		Secure:   st.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// isSafeMethod reports whether a request with this method must not change
+// anything, and so needs no CSRF token.
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// CSRFMiddleware rejects state-changing requests that don't carry the CSRF
+// token of their session, in the X-CSRF-Token header or csrf_token form
+// field. It must run inside SessionStore.Middleware.
+func CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSafeMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		s := sessionFrom(r.Context())
+		token := r.Header.Get(csrfHeader)
+		if token == "" {
+			// Only form bodies are parsed; JSON clients use the header.
+			token = r.PostFormValue(csrfFormField)
+		}
+		if s == nil || token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.CSRFToken)) != 1 {
+			jsonError(w, http.StatusForbidden, "Invalid or missing CSRF token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireLogin lets only logged-in users through. Browsers are sent to
+// the login page; htmx and API clients get 401.
+func RequireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentUser(r) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if isHTMX(r) {
+			w.Header().Set("HX-Redirect", "/login")
+		} else if r.Method == http.MethodGet && wantsHTML(r) {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		jsonError(w, http.StatusUnauthorized, "Login required")
+	})
+}
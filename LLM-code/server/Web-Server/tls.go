@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// selfSignedValidity is how long a generated development certificate lasts.
+const selfSignedValidity = 30 * 24 * time.Hour
+
+// certStore holds the server's certificate. Reload swaps in a new one
+// read from the same files: handshakes from then on use it, while open
+// connections carry on with the old one, so nothing is dropped.
+type certStore struct {
+	certFile, keyFile string // empty for a self-signed certificate
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+// loadCertStore reads a PEM certificate (chain) and key.
+func loadCertStore(certFile, keyFile string) (*certStore, error) {
+	cs := &certStore{certFile: certFile, keyFile: keyFile}
+	if err := cs.Reload(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// selfSignedCertStore generates a certificate for localhost, for local
+// development only: browsers warn about it until it is trusted.
+func selfSignedCertStore() (*certStore, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "localhost", Organization: []string{"Web-Server development"}},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cs := &certStore{}
+	cs.cert.Store(&tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf})
+	return cs, nil
+}
+
+// Reload reads the certificate files again. On error the current
+// certificate stays in use. A self-signed certificate is kept as it is.
+func (cs *certStore) Reload() error {
+	if cs.certFile == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(cs.certFile, cs.keyFile)
+	if err != nil {
+		return err
+	}
+	cs.cert.Store(&cert)
+	return nil
+}
+
+// Expires returns when the current certificate stops being valid.
+func (cs *certStore) Expires() time.Time {
+	return cs.cert.Load().Leaf.NotAfter
+}
+
+// TLSConfig returns a server configuration that always presents the
+// current certificate.
+func (cs *certStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cs.cert.Load(), nil
+		},
+	}
+}
+
+// http2Config tunes HTTP/2 for a small API: a moderate number of streams
+// per connection, and pings to find connections whose peer has vanished.
+func http2Config() *http.HTTP2Config {
+	return &http.HTTP2Config{
+		MaxConcurrentStreams:          250,
+		MaxReadFrameSize:              1 << 20,
+		MaxReceiveBufferPerConnection: 4 << 20,
+		MaxReceiveBufferPerStream:     1 << 20,
+		SendPingTimeout:               30 * time.Second,
+		PingTimeout:                   15 * time.Second,
+		WriteByteTimeout:              30 * time.Second,
+	}
+}
+
+// redirectToHTTPS answers every request with a permanent redirect to the
+// same URL over HTTPS on the port of httpsAddr. 308 keeps the method and
+// body, unlike 301.
+func redirectToHTTPS(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.Trim(r.Host, "[]")
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if host == "" {
+			jsonError(w, http.StatusBadRequest, "Missing Host header")
+			return
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+			host = "[" + host + "]" // IPv6 literal
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
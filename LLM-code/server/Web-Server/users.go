@@ -0,0 +1,119 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// User is an example data model
+type User struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Errors returned by a UserRepository.
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user ID already exists")
+)
+
+// UserRepository stores users. Implementations must be safe for concurrent
+// use, and should give up with ctx.Err() once the request's context is
+// done.
+type UserRepository interface {
+	// List returns all users, ordered by ID.
+	List(ctx context.Context) ([]User, error)
+	// Get returns the user with the given ID, or ErrUserNotFound.
+	Get(ctx context.Context, id string) (User, error)
+	// Create adds a user, or fails with ErrUserExists if the ID is taken.
+	Create(ctx context.Context, u User) error
+	// Update replaces the user with u.ID, or fails with ErrUserNotFound.
+	Update(ctx context.Context, u User) error
+	// Delete removes the user with the given ID, or fails with
+	// ErrUserNotFound.
+	Delete(ctx context.Context, id string) error
+}
+
+// MemoryUserRepository is an in-memory UserRepository (replace with a
+// database for production). The zero value is not usable; call
+// NewMemoryUserRepository.
+type MemoryUserRepository struct {
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+// NewMemoryUserRepository returns a repository holding the given users.
+func NewMemoryUserRepository(seed ...User) *MemoryUserRepository {
+	repo := &MemoryUserRepository{users: make(map[string]User, len(seed))}
+	for _, u := range seed {
+		repo.users[u.ID] = u
+	}
+	return repo
+}
+
+func (m *MemoryUserRepository) List(ctx context.Context) ([]User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return slices.SortedFunc(maps.Values(m.users), func(a, b User) int {
+		return cmp.Compare(a.ID, b.ID)
+	}), nil
+}
+
+func (m *MemoryUserRepository) Get(ctx context.Context, id string) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{}, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u, ok := m.users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return u, nil
+}
+
+func (m *MemoryUserRepository) Create(ctx context.Context, u User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.users[u.ID]; exists {
+		return ErrUserExists
+	}
+	m.users[u.ID] = u
+	return nil
+}
+
+func (m *MemoryUserRepository) Update(ctx context.Context, u User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.users[u.ID]; !exists {
+		return ErrUserNotFound
+	}
+	m.users[u.ID] = u
+	return nil
+}
+
+func (m *MemoryUserRepository) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.users[id]; !exists {
+		return ErrUserNotFound
+	}
+	delete(m.users, id)
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMemoryUserRepositoryErrors(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryUserRepository(User{ID: "1", Name: "Alice"})
+
+	if err := repo.Create(ctx, User{ID: "1", Name: "Again"}); !errors.Is(err, ErrUserExists) {
+		t.Errorf("Create of a taken ID = %v, want ErrUserExists", err)
+	}
+	if _, err := repo.Get(ctx, "2"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Get of a missing ID = %v, want ErrUserNotFound", err)
+	}
+	if err := repo.Update(ctx, User{ID: "2", Name: "Bob"}); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Update of a missing ID = %v, want ErrUserNotFound", err)
+	}
+	if err := repo.Delete(ctx, "2"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Delete of a missing ID = %v, want ErrUserNotFound", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := repo.List(cancelled); !errors.Is(err, context.Canceled) {
+		t.Errorf("List with a cancelled context = %v, want context.Canceled", err)
+	}
+	if err := repo.Create(cancelled, User{ID: "3", Name: "Carol"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Create with a cancelled context = %v, want context.Canceled", err)
+	}
+}
+
+// TestMemoryUserRepositoryConcurrent runs every operation from many
+// goroutines at once; run it with -race.
+func TestMemoryUserRepositoryConcurrent(t *testing.T) {
+	const workers = 50
+	ctx := context.Background()
+	repo := NewMemoryUserRepository(User{ID: "seed", Name: "Seed"})
+
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Go(func() {
+			id := fmt.Sprintf("user-%02d", i)
+			if err := repo.Create(ctx, User{ID: id, Name: "New"}); err != nil {
+				t.Errorf("Create(%s): %v", id, err)
+				return
+			}
+			if err := repo.Update(ctx, User{ID: id, Name: "Renamed"}); err != nil {
+				t.Errorf("Update(%s): %v", id, err)
+			}
+			if u, err := repo.Get(ctx, id); err != nil || u.Name != "Renamed" {
+				t.Errorf("Get(%s) = %+v, %v; want the renamed user", id, u, err)
+			}
+			if _, err := repo.List(ctx); err != nil {
+				t.Errorf("List: %v", err)
+			}
+			// Everyone also races for one shared ID: exactly one wins.
+			repo.Create(ctx, User{ID: "shared", Name: id})
+			if i%2 == 0 {
+				if err := repo.Delete(ctx, id); err != nil {
+					t.Errorf("Delete(%s): %v", id, err)
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	users, err := repo.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The seed, the shared user and the odd-numbered users remain.
+	if want := 2 + workers/2; len(users) != want {
+		t.Errorf("List returned %d users, want %d", len(users), want)
+	}
+	if !slices.IsSortedFunc(users, func(a, b User) int { return strings.Compare(a.ID, b.ID) }) {
+		t.Errorf("List is not ordered by ID: %v", users)
+	}
+}
+
+// TestUsersHandlersConcurrent posts users and lists them through the
+// handlers at the same time; run it with -race.
+func TestUsersHandlersConcurrent(t *testing.T) {
+	const workers = 50
+	repo := NewMemoryUserRepository()
+	app := NewApp(repo, nil, nil, nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /users", app.CreateUserHandler)
+	mux.HandleFunc("GET /users", app.ListUsersHandler)
+
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Go(func() {
+			body := fmt.Sprintf(`{"id":"user-%02d","name":"User %d"}`, i, i)
+			req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != http.StatusCreated {
+				t.Errorf("POST %s: status %d, body %s", body, rec.Code, rec.Body)
+			}
+		})
+		wg.Go(func() {
+			req := httptest.NewRequest(http.MethodGet, "/users", nil)
+			req.Header.Set("Accept", "application/json")
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			var users []User
+			if rec.Code != http.StatusOK {
+				t.Errorf("GET /users: status %d, body %s", rec.Code, rec.Body)
+			} else if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+				t.Errorf("GET /users: %v", err)
+			}
+		})
+	}
+	wg.Wait()
+
+	req := httptest.NewRequest(http.MethodGet, "/users", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	var users []User
+	if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != workers {
+		t.Errorf("GET /users returned %d users, want %d", len(users), workers)
+	}
+}
+
+func TestCreateUserHandlerDuplicate(t *testing.T) {
+	views, err := NewViews()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := NewApp(NewMemoryUserRepository(User{ID: "1", Name: "Alice"}), views, nil, nil)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		header      map[string]string
+		want        int
+	}{
+		{"JSON", "application/json", `{"id":"1","name":"Again"}`, nil, http.StatusConflict},
+		{"form from a script", "application/x-www-form-urlencoded", "id=1&name=Again", map[string]string{"Accept": "application/json"}, http.StatusConflict},
+		{"form from htmx", "application/x-www-form-urlencoded", "id=1&name=Again", map[string]string{"HX-Request": "true"}, http.StatusUnprocessableEntity},
+		{"form from a browser", "application/x-www-form-urlencoded", "id=1&name=Again", map[string]string{"Accept": "text/html"}, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			app.CreateUserHandler(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d; body %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"html/template"
+	"net/http"
+)
+
+// templateFiles holds the HTML views. Each defines named fragments that
+// htmx requests get on their own; other requests get them inside "layout".
+//
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+// Views renders the HTML templates.
+type Views struct {
+	t *template.Template
+}
+
+// NewViews parses the embedded templates.
+func NewViews() (*Views, error) {
+	t, err := template.New("").Funcs(template.FuncMap{"row": newUserRow}).ParseFS(templateFiles, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+	return &Views{t: t}, nil
+}
+
+// isHTMX reports whether the request was made by htmx, which wants a
+// fragment to swap into the page rather than a whole document.
+func isHTMX(r *http.Request) bool {
+	return r.Header.Get("HX-Request") == "true"
+}
+
+// layoutData is what the "layout" template renders around a fragment.
+type layoutData struct {
+	Title     string
+	Body      template.HTML
+	User      string // logged-in user, if any
+	CSRFToken string // sent by htmx with every request
+	Nonce     string // CSP nonce for inline scripts and styles
+}
+
+// userTable is the data of the "user-table" template.
+type userTable struct {
+	Users    []User
+	Editable bool // whether rows get edit and delete buttons
+}
+
+// userRow is the data of the "user-row" template.
+type userRow struct {
+	User
+	Editable bool
+}
+
+func newUserRow(u User, editable bool) userRow {
+	return userRow{User: u, Editable: editable}
+}
+
+// Render writes the named fragment with the given status: on its own for
+// htmx requests, wrapped in the full page otherwise. The output is
+// buffered, so a template error still gets a clean 500 response.
+func (v *Views) Render(w http.ResponseWriter, r *http.Request, status int, title, name string, data any) {
+	var body bytes.Buffer
+	if err := v.t.ExecuteTemplate(&body, name, data); err != nil {
+		v.renderError(w, r, name, err)
+		return
+	}
+	if !isHTMX(r) {
+		fragment := body.String()
+		body.Reset()
+		// The fragment was escaped by html/template as it was rendered.
+		page := layoutData{Title: title, Body: template.HTML(fragment), Nonce: cspNonce(r.Context())}
+		if s := sessionFrom(r.Context()); s != nil {
+			page.User, page.CSRFToken = s.Username, s.CSRFToken
+		}
+		if err := v.t.ExecuteTemplate(&body, "layout", page); err != nil {
+			v.renderError(w, r, "layout", err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+func (v *Views) renderError(w http.ResponseWriter, r *http.Request, name string, err error) {
+	loggerFrom(r.Context()).Error("Failed to render template", "template", name, "error", err)
+	jsonError(w, http.StatusInternalServerError, "Internal server error")
+}
+
+// setTrigger sets the HX-Trigger header, which makes htmx fire the event
+// name, with detail as its event.detail, once the response is swapped in.
+func setTrigger(w http.ResponseWriter, r *http.Request, name string, detail any) {
+	b, err := json.Marshal(map[string]any{name: detail})
+	if err != nil {
+		loggerFrom(r.Context()).Error("Failed to encode HX-Trigger", "error", err)
+		return
+	}
+	w.Header().Set("HX-Trigger", string(b))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// wrappedWriter is what the ResponseWriter wrappers in this package embed
+// instead of http.ResponseWriter. Embedding the interface would hide the
+// http.Flusher, http.Hijacker and io.ReaderFrom that net/http's writer also
+// implements, which breaks streaming, protocol upgrades and sendfile.
+// wrappedWriter passes them on to the writer it wraps, and Unwrap lets
+// http.ResponseController reach it too. Wrappers that change what gets
+// written override these methods as well as Write.
+//
+// A wrapper has all these methods whatever it wraps, so handlers aren't
+// given the wrapper itself but what exposeLike makes of it.
+type wrappedWriter struct {
+	http.ResponseWriter
+}
+
+// Flush flushes the wrapped writer if it can be flushed.
+func (w wrappedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack takes over the connection if the wrapped writer allows it.
+func (w wrappedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// ReadFrom lets the wrapped writer copy from src itself (with sendfile,
+// for files) where it can.
+func (w wrappedWriter) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(writerOnly{w.ResponseWriter}, src)
+}
+
+// Unwrap returns the wrapped writer, for http.ResponseController.
+func (w wrappedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// writerOnly hides everything but Write, so io.Copy can't call back into
+// a ReadFrom method.
+type writerOnly struct {
+	io.Writer
+}
+
+// wrapper is what the ResponseWriter wrappers in this package implement.
+// FlushError lets http.ResponseController report a failed flush.
+type wrapper interface {
+	http.ResponseWriter
+	http.Flusher
+	http.Hijacker
+	io.ReaderFrom
+	Unwrap() http.ResponseWriter
+	FlushError() error
+}
+
+// wrapperBase is the part of a wrapper that exposeLike always keeps.
+type wrapperBase interface {
+	http.ResponseWriter
+	Unwrap() http.ResponseWriter
+	FlushError() error
+}
+
+// exposeLike returns w as a writer that is an http.Flusher, http.Hijacker
+// or io.ReaderFrom only if inner, the writer w wraps, is one, so that
+// handlers checking for them with a type assertion get the same answer
+// they would without the wrapper.
+func exposeLike(w wrapper, inner http.ResponseWriter) http.ResponseWriter {
+	_, flusher := inner.(http.Flusher)
+	_, hijacker := inner.(http.Hijacker)
+	_, readerFrom := inner.(io.ReaderFrom)
+	switch {
+	case flusher && hijacker && readerFrom:
+		return struct {
+			wrapperBase
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{w, w, w, w}
+	case flusher && hijacker:
+		return struct {
+			wrapperBase
+			http.Flusher
+			http.Hijacker
+		}{w, w, w}
+	case flusher && readerFrom:
+		return struct {
+			wrapperBase
+			http.Flusher
+			io.ReaderFrom
+		}{w, w, w}
+	case hijacker && readerFrom:
+		return struct {
+			wrapperBase
+			http.Hijacker
+			io.ReaderFrom
+		}{w, w, w}
+	case flusher:
+		return struct {
+			wrapperBase
+			http.Flusher
+		}{w, w}
+	case hijacker:
+		return struct {
+			wrapperBase
+			http.Hijacker
+		}{w, w}
+	case readerFrom:
+		return struct {
+			wrapperBase
+			io.ReaderFrom
+		}{w, w}
+	}
+	return struct{ wrapperBase }{w}
+}
+
+// responseRecorder is used in LoggingMiddleware, RecoverMiddleware and
+// Metrics to capture the status code, whether the response has started and
+// how many body bytes were written
+type responseRecorder struct {
+	wrappedWriter
+	statusCode  int
+	wroteHeader bool
+	bytes       int64
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{wrappedWriter: wrappedWriter{w}, statusCode: http.StatusOK}
+}
+
+func (rr *responseRecorder) WriteHeader(code int) {
+	if !rr.wroteHeader {
+		rr.statusCode = code
+		rr.wroteHeader = code >= 200
+	}
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.wroteHeader = true
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += int64(n)
+	return n, err
+}
+
+func (rr *responseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	rr.wroteHeader = true
+	n, err := rr.wrappedWriter.ReadFrom(src)
+	rr.bytes += n
+	return n, err
+}
+
+func (rr *responseRecorder) Flush() {
+	rr.FlushError()
+}
+
+// FlushError flushes the wrapped writer, or returns http.ErrNotSupported
+// if it can't be flushed. Once flushed, the response has started.
+func (rr *responseRecorder) FlushError() error {
+	rr.wroteHeader = true
+	return http.NewResponseController(rr.ResponseWriter).Flush()
+}
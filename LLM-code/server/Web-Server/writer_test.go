@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// bareWriter is a ResponseWriter that is none of http.Flusher,
+// http.Hijacker and io.ReaderFrom.
+type bareWriter struct {
+	http.ResponseWriter
+}
+
+// TestWrappersExposeLikeInner checks that the middlewares' writers are an
+// http.Flusher, http.Hijacker or io.ReaderFrom exactly when the writer
+// they wrap is one.
+func TestWrappersExposeLikeInner(t *testing.T) {
+	middlewares := []struct {
+		name string
+		wrap func(http.Handler) http.Handler
+	}{
+		{"responseRecorder", RecoverMiddleware},
+		{"compressWriter", func(h http.Handler) http.Handler { return CompressMiddleware(h, 0) }},
+	}
+	for _, mw := range middlewares {
+		var flusher, hijacker, readerFrom bool
+		handler := mw.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, flusher = w.(http.Flusher)
+			_, hijacker = w.(http.Hijacker)
+			_, readerFrom = w.(io.ReaderFrom)
+		}))
+
+		t.Run(mw.name+" behind net/http", func(t *testing.T) {
+			srv := httptest.NewServer(handler)
+			defer srv.Close()
+			req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if !flusher || !hijacker || !readerFrom {
+				t.Errorf("Flusher %v, Hijacker %v, ReaderFrom %v; want all", flusher, hijacker, readerFrom)
+			}
+		})
+
+		t.Run(mw.name+" behind a bare writer", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			handler.ServeHTTP(bareWriter{httptest.NewRecorder()}, req)
+			if flusher || hijacker || readerFrom {
+				t.Errorf("Flusher %v, Hijacker %v, ReaderFrom %v; want none", flusher, hijacker, readerFrom)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exit codes of batch mode and the loadtest and replay commands.
+const (
+	exitOK       = 0
+	exitConnect  = 1 // could not connect, or the connection dropped
+	exitUsage    = 2 // bad flags, environment or config file
+	exitRejected = 3 // the server rejected a message or didn't confirm it in time
+	exitTimeout  = 4 // -listen ran out before -count messages arrived
+	exitMismatch = 5 // a replay received something other than the recording
+)
+
+// errTimedOut is returned by batch.wait when the deadline passes first.
+var errTimedOut = errors.New("timed out")
+
+// runBatch runs the client without a user at the keyboard, for scripts and
+// cron jobs. It connects, joins the starting room and sends one message
+// made of the command-line arguments or, without arguments, one message
+// per line of stdin (as lines arrive, unless stdin is a terminal). It waits
+// until the server has echoed every message back, then, if -listen or
+// -count was given, keeps listening. Every event received is written to
+// stdout as a JSON line; diagnostics go to stderr. It returns the process
+// exit code.
+func runBatch(u url.URL, proxy *url.URL, opts options, identity *ecdh.PrivateKey, keys *keyring, stdin *bufio.Reader) int {
+	t := newTranscript(newLineDisplay(io.Discard), html.EscapeString(opts.user))
+	s := newSession(u, opts.user, t, identity, keys)
+	s.proxy = proxy
+	rec, err := openRecorder(opts.record)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	defer rec.close()
+	s.rec = rec
+	b := &batch{self: s.self, out: json.NewEncoder(os.Stdout), wake: make(chan struct{}, 1)}
+	s.observe = b.observe
+
+	conn, err := s.connect()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect: %v\n", err)
+		return exitConnect
+	}
+	defer s.close()
+	readErr := make(chan error, 1)
+	go func() { readErr <- s.readLoop(conn) }()
+
+	if opts.room != "" && opts.room != defaultRoom {
+		s.setRoom(opts.room)
+		if err := s.send(event{Type: eventJoin, Room: opts.room}); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to join #%s: %v\n", opts.room, err)
+			return exitConnect
+		}
+	}
+	room := s.currentRoom()
+
+	sent := 0
+	send := func(text string) error {
+		sent++
+		return s.send(event{Type: eventMessage, Room: room, Text: text})
+	}
+	if len(opts.args) > 0 {
+		err = send(strings.Join(opts.args, " "))
+	} else if !isTerminal(os.Stdin) {
+		scanner := bufio.NewScanner(stdin)
+		for err == nil && scanner.Scan() {
+			if line := scanner.Text(); strings.TrimSpace(line) != "" {
+				err = send(line)
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to send: %v\n", err)
+		return exitConnect
+	}
+
+	// The server echoes every room message to its sender, or answers with
+	// an error event.
+	err = b.wait(func() bool { return b.confirmed >= sent || b.rejected != "" }, time.After(opts.timeout), readErr)
+	confirmed, rejected, _ := b.counts()
+	switch {
+	case errors.Is(err, errTimedOut):
+		fmt.Fprintf(os.Stderr, "The server did not confirm %d of %d messages within %v\n", sent-confirmed, sent, opts.timeout)
+		return exitRejected
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "Connection lost: %v\n", err)
+		return exitConnect
+	case rejected != "":
+		fmt.Fprintf(os.Stderr, "The server rejected a message: %s\n", rejected)
+		return exitRejected
+	}
+
+	if opts.listen <= 0 && opts.count <= 0 {
+		return exitOK
+	}
+	var deadline <-chan time.Time
+	if opts.listen > 0 {
+		deadline = time.After(opts.listen)
+	}
+	err = b.wait(func() bool { return opts.count > 0 && b.received >= opts.count }, deadline, readErr)
+	switch {
+	case errors.Is(err, errTimedOut) && opts.count > 0:
+		_, _, received := b.counts()
+		fmt.Fprintf(os.Stderr, "Received %d of %d messages within %v\n", received, opts.count, opts.listen)
+		return exitTimeout
+	case errors.Is(err, errTimedOut):
+		return exitOK
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "Connection lost: %v\n", err)
+		return exitConnect
+	}
+	return exitOK
+}
+
+// batch writes the events a batch session receives to stdout and counts
+// what runBatch waits for.
+type batch struct {
+	self string
+	out  *json.Encoder
+
+	mu        sync.Mutex
+	confirmed int    // our messages echoed back by the server
+	rejected  string // the first error the server sent, if any
+	received  int    // messages from other users
+	wake      chan struct{}
+}
+
+// observe is called by the session with every event received, after
+// private messages have been decrypted.
+func (b *batch) observe(ev event) {
+	if ev.Type == eventTyping || ev.Type == eventRead {
+		return
+	}
+	ev.Key, ev.Nonce, ev.Ciphertext = nil, nil, nil
+	b.out.Encode(ev)
+
+	b.mu.Lock()
+	switch {
+	case ev.Type == eventError && b.rejected == "":
+		b.rejected = ev.Text
+	case ev.Type == eventMessage && ev.From == b.self && !ev.Offline:
+		b.confirmed++
+	case (ev.Type == eventMessage || ev.Type == eventPrivate) && ev.From != b.self:
+		b.received++
+	}
+	b.mu.Unlock()
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (b *batch) counts() (confirmed int, rejected string, received int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.confirmed, b.rejected, b.received
+}
+
+// wait blocks until done reports true, the deadline passes (errTimedOut)
+// or the connection fails. done is called with b.mu held.
+func (b *batch) wait(done func() bool, deadline <-chan time.Time, readErr <-chan error) error {
+	for {
+		b.mu.Lock()
+		ok := done()
+		b.mu.Unlock()
+		if ok {
+			return nil
+		}
+		select {
+		case <-b.wake:
+		case <-deadline:
+			return errTimedOut
+		case err := <-readErr:
+			return err
+		}
+	}
+}
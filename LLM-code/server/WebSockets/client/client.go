@@ -2,115 +2,211 @@ package main
 
 import (
 	"bufio"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"html"
 	"io"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 // This client will:
-// 1. Prompt the user for an IP/port (or use default 127.0.0.1:8080).
-// 2. Prompt for a username.
-// 3. Connect to the server via WebSocket.
-// 4. Send the username as the first message.
-// 5. Listen for incoming messages in one goroutine.
-// 6. Read user input in main goroutine and send to server.
-// 7. Typing "quit" exits the client.
+// 1. Take the server address and username from flags, the environment or
+//    a config profile, prompting for any that are missing.
+// 2. Connect to the server via WebSocket and send the username first.
+// 3. Listen for incoming messages in one goroutine, reconnecting if the
+//    connection drops.
+// 4. Read user input in main goroutine and send to server.
+// 5. Typing "quit" closes the connection cleanly and exits.
+//
+// See the README for the commands, flags, batch mode, load testing and
+// replay.
 
 func main() {
-	serverAddr := promptServerAddress()
-	username := promptUsername()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "loadtest":
+			os.Exit(runLoadTest(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		}
+	}
+
+	// Prompts and the input loop share one reader, so nothing typed ahead
+	// is lost between them.
+	stdin := bufio.NewReader(os.Stdin)
+	opts, err := loadOptions(stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+	username := opts.user
 
-	u := url.URL{Scheme: "ws", Host: serverAddr, Path: "/ws"}
+	u := url.URL{Scheme: "ws", Host: opts.addr, Path: "/ws"}
+	if opts.tls {
+		u.Scheme = "wss"
+	}
+
+	proxy, err := opts.proxyFor(u)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+
+	identity, keys := loadKeys()
+	if opts.batch {
+		os.Exit(runBatch(u, proxy, opts, identity, keys, stdin))
+	}
 
 	fmt.Printf("Connecting to %s...\n", u.String())
 
-	// Connect to the server
-	conn, err := dialWebSocket(u)
+	// Use the full-screen interface on a terminal, plain lines otherwise.
+	var ui *tui
+	var out display = newLineDisplay(os.Stdout)
+	if isTerminal(os.Stdin) && isTerminal(os.Stdout) {
+		if ui, err = newTUI(); err == nil {
+			out = ui
+		} else {
+			fmt.Printf("Warning: full-screen mode unavailable (%v)\n", err)
+		}
+	}
+	t := newTranscript(out, html.EscapeString(username))
+	s := newSession(u, username, t, identity, keys)
+	s.proxy = proxy
+	rec, err := openRecorder(opts.record)
 	if err != nil {
-		fmt.Printf("Failed to connect: %v\n", err)
+		if ui != nil {
+			ui.close()
+		}
+		fmt.Println(err)
 		return
 	}
-	defer conn.Close()
+	defer rec.close()
+	s.rec = rec
+	if opts.history {
+		if s.history, err = openHistory(u.Host); err != nil {
+			t.println(fmt.Sprintf("Warning: local history unavailable (%v)", err))
+		}
+	}
 
-	// Send username as the first message
-	if err := writeWebSocketFrame(conn, 0x1, []byte(username)); err != nil {
-		fmt.Printf("Failed to send username: %v\n", err)
+	// Connect to the server; later drops are retried by s.run
+	conn, err := s.connect()
+	if err != nil {
+		if ui != nil {
+			ui.close()
+		}
+		fmt.Printf("Failed to connect: %v\n", err)
 		return
 	}
+	defer s.close()
+	t.setConnState("connected to " + u.Host)
+	if opts.room != "" && opts.room != defaultRoom {
+		s.setRoom(opts.room)
+		s.queue(event{Type: eventJoin, Room: opts.room})
+	}
 
-	// Start a goroutine to read messages from server
-	go func() {
-		for {
-			opcode, payload, err := readWebSocketFrame(conn)
-			if err != nil {
-				fmt.Println("Connection closed by server.")
-				os.Exit(0)
-			}
-			if opcode == 0x8 {
-				fmt.Println("Server sent close frame. Exiting.")
-				os.Exit(0)
-			}
-			fmt.Println(string(payload))
-		}
-	}()
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.sendReceipts(stop)
+
+	// Read messages from the server in the background, reconnecting as needed
+	go s.run(conn)
 
 	// Read user input and send to server
-	scanner := bufio.NewScanner(os.Stdin)
+	if ui != nil {
+		defer ui.close()
+		ui.run(s.handleInput, s.noteTyping)
+		return
+	}
+	scanner := bufio.NewScanner(typingReader{r: stdin, onInput: s.noteTyping})
 	for {
 		if !scanner.Scan() {
 			// EOF or error
 			fmt.Println("Exiting...")
 			return
 		}
-		msg := scanner.Text()
-		if strings.ToLower(msg) == "quit" {
-			writeWebSocketFrame(conn, 0x8, []byte{})
-			return
-		}
-		if err := writeWebSocketFrame(conn, 0x1, []byte(msg)); err != nil {
-			fmt.Printf("Failed to send message: %v\n", err)
+		t.inputLine()
+		if !s.handleInput(scanner.Text()) {
 			return
 		}
 	}
 }
 
-func promptServerAddress() string {
-	fmt.Print("Enter server IP and port (default 127.0.0.1:8080): ")
-	scanner := bufio.NewScanner(os.Stdin)
-	scanner.Scan()
-	addr := scanner.Text()
-	if strings.TrimSpace(addr) == "" {
-		addr = "127.0.0.1:8080"
+// loadKeys loads the identity key used for private messages and the
+// keyring of pinned keys from the config directory. If that isn't possible
+// a temporary identity is used, so private messages still work but the
+// fingerprint changes every run.
+func loadKeys() (*ecdh.PrivateKey, *keyring) {
+	dir, err := configDir()
+	if err == nil {
+		var identity *ecdh.PrivateKey
+		identity, err = loadIdentity(filepath.Join(dir, "identity.key"))
+		if err == nil {
+			var keys *keyring
+			keys, err = loadKeyring(filepath.Join(dir, "known_keys.json"))
+			if err == nil {
+				return identity, keys
+			}
+		}
 	}
-	return addr
-}
-
-func promptUsername() string {
-	fmt.Print("Enter a username: ")
-	scanner := bufio.NewScanner(os.Stdin)
-	scanner.Scan()
-	username := scanner.Text()
-	if strings.TrimSpace(username) == "" {
-		username = "Anonymous"
+	fmt.Fprintf(os.Stderr, "Warning: using a temporary encryption key (%v)\n", err)
+	identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
 	}
-	return username
+	return identity, &keyring{pinned: make(map[string][]byte)}
 }
 
-func dialWebSocket(u url.URL) (net.Conn, error) {
+// dialTimeout bounds connecting to the server or proxy, and each of the
+// proxy, TLS and WebSocket handshakes, so an unreachable or stalled host
+// fails instead of hanging.
+const dialTimeout = 10 * time.Second
+
+var dialer = net.Dialer{Timeout: dialTimeout}
+
+// dialWebSocket connects to the server at u, through proxy unless it is
+// nil, and performs the opening handshake.
+func dialWebSocket(u url.URL, proxy *url.URL) (net.Conn, error) {
 	// The handshake for WebSocket over standard library net/http requires us to do it manually.
-	// We'll do a basic WebSocket handshake.
-	conn, err := net.Dial("tcp", u.Host)
+	var conn net.Conn
+	var err error
+	if proxy != nil {
+		conn, err = dialProxy(proxy, hostPort(u))
+	} else {
+		conn, err = dialer.Dial("tcp", hostPort(u))
+	}
 	if err != nil {
 		return nil, err
 	}
+	// A server that accepts the connection and then stalls mustn't hang
+	// the client, so the TLS and WebSocket handshakes are bounded too.
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if u.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
 
 	// Perform WebSocket handshake:
 	// Generate a Sec-WebSocket-Key and send required headers.
-	key := generateWebSocketKey()
+	key, err := generateWebSocketKey()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 	req := fmt.Sprintf("GET %s HTTP/1.1\r\n"+
 		"Host: %s\r\n"+
 		"Upgrade: websocket\r\n"+
@@ -123,39 +219,101 @@ func dialWebSocket(u url.URL) (net.Conn, error) {
 		return nil, err
 	}
 
-	// Read the response and validate
-	resp := bufio.NewReader(conn)
-	statusLine, err := resp.ReadString('\n')
+	// Read the response and validate it as RFC 6455 section 4.1 requires.
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet})
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
-	if !strings.Contains(statusLine, "101") {
+	resp.Body.Close()
+	if err := checkHandshakeResponse(resp, key); err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("server did not return 101 switching protocols")
+		return nil, err
 	}
+	conn.SetDeadline(time.Time{})
 
-	// Read headers until blank line
-	for {
-		line, err := resp.ReadString('\n')
-		if err != nil {
-			conn.Close()
-			return nil, err
-		}
-		if strings.TrimSpace(line) == "" {
-			// Handshake complete
-			break
+	// The reader may already hold the first frames, so keep reading through it.
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// hostPort returns the address to dial for u, adding the default port for
+// its scheme if it has none.
+func hostPort(u url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "wss" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// checkHandshakeResponse verifies the server accepted our upgrade request
+// with the key we sent and didn't pick extensions or subprotocols we never
+// offered.
+func checkHandshakeResponse(resp *http.Response, key string) error {
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("server did not return 101 switching protocols: %s", resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return errors.New("handshake response is missing Upgrade: websocket")
+	}
+	if !headerHasToken(resp.Header, "Connection", "upgrade") {
+		return errors.New("handshake response is missing Connection: Upgrade")
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != computeAcceptKey(key) {
+		return errors.New("handshake response has an invalid Sec-WebSocket-Accept")
+	}
+	if resp.Header.Get("Sec-WebSocket-Extensions") != "" {
+		return errors.New("server selected an extension we did not offer")
+	}
+	if resp.Header.Get("Sec-WebSocket-Protocol") != "" {
+		return errors.New("server selected a subprotocol we did not offer")
+	}
+	return nil
+}
+
+// headerHasToken reports whether the comma-separated header name contains
+// token, ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
 		}
 	}
+	return false
+}
 
-	// Return the same conn, but wrapped in a *bufio.ReadWriter for frame functions
-	// We'll just return the net.Conn and let read/writeWebSocketFrame handle it directly.
-	return conn, nil
+// bufferedConn reads through the bufio.Reader used for the handshake, so
+// bytes it already buffered aren't lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
 }
 
-func generateWebSocketKey() string {
-	// A valid key is a random 16-byte value base64 encoded. For simplicity:
-	return "dGhlIHNhbXBsZSBub25jZQ==" // This is a static key used in RFC examples.
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// generateWebSocketKey returns a random 16-byte value, base64 encoded.
+func generateWebSocketKey() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b[:]), nil
+}
+
+// computeAcceptKey returns the Sec-WebSocket-Accept value a server must
+// answer with for key.
+func computeAcceptKey(key string) string {
+	const magicGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	h := sha1.New()
+	h.Write([]byte(key + magicGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
 func readWebSocketFrame(conn net.Conn) (byte, []byte, error) {
@@ -170,7 +328,9 @@ func readWebSocketFrame(conn net.Conn) (byte, []byte, error) {
 		return 0, nil, errors.New("fragmented frames not supported in this example")
 	}
 
-	mask := (header[1] & 0x80) != 0
+	if header[1]&0x80 != 0 {
+		return 0, nil, errors.New("server frames must not be masked")
+	}
 	payloadLen := int64(header[1] & 0x7f)
 
 	switch payloadLen {
@@ -191,49 +351,44 @@ func readWebSocketFrame(conn net.Conn) (byte, []byte, error) {
 			uint64(ext[6])<<8 | uint64(ext[7])))
 	}
 
-	var maskKey [4]byte
-	if mask {
-		if _, err := io.ReadFull(conn, maskKey[:]); err != nil {
-			return 0, nil, err
-		}
-	}
-
 	payload := make([]byte, payloadLen)
 	if _, err := io.ReadFull(conn, payload); err != nil {
 		return 0, nil, err
 	}
 
-	if mask {
-		for i := int64(0); i < payloadLen; i++ {
-			payload[i] ^= maskKey[i%4]
-		}
-	}
-
 	return opcode, payload, nil
 }
 
+// writeWebSocketFrame writes a single frame. Clients must mask every frame
+// they send (RFC 6455 section 5.3), using a fresh random key each time.
 func writeWebSocketFrame(conn net.Conn, opcode byte, payload []byte) error {
 	var header []byte
 	payloadLen := len(payload)
 
 	switch {
 	case payloadLen <= 125:
-		header = []byte{0x80 | opcode, byte(payloadLen)}
+		header = []byte{0x80 | opcode, 0x80 | byte(payloadLen)}
 	case payloadLen < 65536:
-		header = []byte{0x80 | opcode, 126, byte(payloadLen >> 8), byte(payloadLen & 0xff)}
+		header = []byte{0x80 | opcode, 0x80 | 126, byte(payloadLen >> 8), byte(payloadLen & 0xff)}
 	default:
-		header = []byte{0x80 | opcode, 127,
+		header = []byte{0x80 | opcode, 0x80 | 127,
 			byte(payloadLen >> 56), byte(payloadLen >> 48),
 			byte(payloadLen >> 40), byte(payloadLen >> 32),
 			byte(payloadLen >> 24), byte(payloadLen >> 16),
 			byte(payloadLen >> 8), byte(payloadLen)}
 	}
 
-	if _, err := conn.Write(header); err != nil {
+	var maskKey [4]byte
+	if _, err := rand.Read(maskKey[:]); err != nil {
 		return err
 	}
-	if _, err := conn.Write(payload); err != nil {
-		return err
+	frame := make([]byte, 0, len(header)+len(maskKey)+payloadLen)
+	frame = append(frame, header...)
+	frame = append(frame, maskKey[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^maskKey[i%4])
 	}
-	return nil
+
+	_, err := conn.Write(frame)
+	return err
 }
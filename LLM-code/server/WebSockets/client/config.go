@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults offered when a value has to be prompted for.
+const (
+	defaultAddr     = "127.0.0.1:8080"
+	defaultUsername = "Anonymous"
+)
+
+// options says where to connect and as whom. Each value comes from, in
+// order of precedence: a command-line flag, an environment variable, the
+// selected profile of the config file, or finally a prompt.
+type options struct {
+	addr string // host:port
+	user string
+	room string // room to start in; the lobby if empty
+	tls  bool   // connect with wss://
+
+	proxy   string // proxy URL; the environment decides if empty
+	record  string // file to record every frame to (see record.go)
+	history bool   // keep a local history of room messages (see history.go)
+
+	// Batch mode (see runBatch) is turned on by -batch, and implied by
+	// -listen, -count or message arguments.
+	batch   bool
+	args    []string      // message to send, one word per argument
+	listen  time.Duration // how long to listen after sending
+	count   int           // stop listening after this many messages
+	timeout time.Duration // how long to wait for sent messages to be confirmed
+}
+
+// profile is a named server in the config file.
+type profile struct {
+	Addr string `json:"addr,omitempty"`
+	User string `json:"user,omitempty"`
+	Room string `json:"room,omitempty"`
+	TLS  bool   `json:"tls,omitempty"`
+}
+
+// clientConfig is the format of config.json in the config directory, e.g.
+//
+//	{
+//	  "default": "home",
+//	  "profiles": {
+//	    "home": {"addr": "127.0.0.1:8080", "user": "alice"},
+//	    "work": {"addr": "chat.example.com:443", "user": "alice", "room": "ops", "tls": true}
+//	  }
+//	}
+type clientConfig struct {
+	Default  string             `json:"default,omitempty"`
+	Profiles map[string]profile `json:"profiles,omitempty"`
+}
+
+// loadOptions parses the command line and environment, applies the chosen
+// profile and prompts on stdin for whatever is still missing.
+func loadOptions(stdin *bufio.Reader) (options, error) {
+	profileName := flag.String("profile", os.Getenv("CHAT_PROFILE"), "server profile from the config file (default: the file's \"default\")")
+	addr := flag.String("addr", os.Getenv("CHAT_ADDR"), "server address as host:port (env CHAT_ADDR)")
+	user := flag.String("user", os.Getenv("CHAT_USER"), "username (env CHAT_USER)")
+	room := flag.String("room", os.Getenv("CHAT_ROOM"), "room to join on start (env CHAT_ROOM)")
+	useTLS := flag.Bool("tls", false, "connect over TLS (wss://) (env CHAT_TLS)")
+	proxy := flag.String("proxy", "", "proxy URL, http://, socks5:// or socks5h://, with optional user:password@ (default from HTTPS_PROXY, HTTP_PROXY or ALL_PROXY)")
+	record := flag.String("record", "", "record every frame sent and received to this file, for \"replay\"")
+	keepHistory := flag.Bool("history", true, "keep a local history of room messages for /history, /search and /export")
+	batch := flag.Bool("batch", false, "run without prompts or a user interface: send the arguments or stdin lines, print events as JSON lines")
+	listen := flag.Duration("listen", 0, "in batch mode, keep listening this long after sending")
+	count := flag.Int("count", 0, "in batch mode, stop listening after this many messages")
+	timeout := flag.Duration("timeout", 10*time.Second, "in batch mode, how long to wait for the server to confirm sent messages")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [message...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return options{}, err
+	}
+	p, err := cfg.profile(*profileName)
+	if err != nil {
+		return options{}, err
+	}
+
+	opts := options{
+		addr: cmp.Or(*addr, p.Addr),
+		// The server trims the name it is sent, so trim it here too: it is
+		// compared with the names in events and sent in the handshake.
+		user: cmp.Or(strings.TrimSpace(*user), strings.TrimSpace(p.User)),
+		room: cmp.Or(*room, p.Room),
+		tls:  p.TLS,
+
+		proxy:   *proxy,
+		record:  *record,
+		history: *keepHistory,
+
+		batch:   *batch || *listen > 0 || *count > 0 || flag.NArg() > 0,
+		args:    flag.Args(),
+		listen:  *listen,
+		count:   *count,
+		timeout: *timeout,
+	}
+	if v, ok := os.LookupEnv("CHAT_TLS"); ok {
+		if opts.tls, err = strconv.ParseBool(v); err != nil {
+			return options{}, fmt.Errorf("CHAT_TLS: %w", err)
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "tls" {
+			opts.tls = *useTLS
+		}
+	})
+
+	if opts.batch {
+		opts.addr = cmp.Or(opts.addr, defaultAddr)
+		opts.user = cmp.Or(opts.user, defaultUsername)
+		return opts, nil
+	}
+	if opts.addr == "" {
+		opts.addr = prompt(stdin, "Enter server IP and port (default "+defaultAddr+"): ", defaultAddr)
+	}
+	if opts.user == "" {
+		opts.user = prompt(stdin, "Enter a username: ", defaultUsername)
+	}
+	return opts, nil
+}
+
+// proxyFor returns the proxy to reach u through, or nil to connect
+// directly.
+func (o options) proxyFor(u url.URL) (*url.URL, error) {
+	if o.proxy != "" {
+		return parseProxy(o.proxy)
+	}
+	return proxyFromEnvironment(u, os.Getenv)
+}
+
+// loadConfig reads config.json from the config directory. A missing file
+// is the same as an empty one.
+func loadConfig() (clientConfig, error) {
+	var cfg clientConfig
+	dir, err := configDir()
+	if err != nil {
+		return cfg, nil
+	}
+	path := filepath.Join(dir, "config.json")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// profile returns the named profile, or the default one if name is empty.
+// Without either it returns an empty profile.
+func (c clientConfig) profile(name string) (profile, error) {
+	if name == "" {
+		name = c.Default
+		if name == "" {
+			return profile{}, nil
+		}
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		return profile{}, fmt.Errorf("no profile %q in the config file", name)
+	}
+	return p, nil
+}
+
+// prompt asks a question on stdout and reads the answer from stdin,
+// returning fallback if the answer is empty. All prompts share one reader,
+// so input typed ahead is kept for whoever reads stdin next.
+func prompt(stdin *bufio.Reader, question, fallback string) string {
+	fmt.Print(question)
+	answer, _ := stdin.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return fallback
+	}
+	return answer
+}
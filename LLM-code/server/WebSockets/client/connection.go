@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"time"
+)
+
+// Reconnect delays grow exponentially from reconnectMin up to reconnectMax,
+// with jitter so that clients dropped together don't all retry together.
+const (
+	reconnectMin = 500 * time.Millisecond
+	reconnectMax = 30 * time.Second
+)
+
+// maxOutbox bounds how many typed events are held while offline.
+const maxOutbox = 100
+
+// The client pings the server every pingInterval, and gives up on the
+// connection when maxMissedPongs pings in a row go unanswered.
+const (
+	pingInterval   = 15 * time.Second
+	maxMissedPongs = 2
+)
+
+// closeTimeout is how long close waits for the server to answer a close
+// frame before hanging up anyway.
+const closeTimeout = 2 * time.Second
+
+// closeNormal is the status code sent in our close frame (RFC 6455, 7.4.1).
+const closeNormal = 1000
+
+// errOffline is returned by send while the client is reconnecting.
+var errOffline = errors.New("not connected")
+
+// errNoPong is returned by readLoop when keepalive gives up on the server.
+var errNoPong = errors.New("server stopped answering pings")
+
+// connect dials the server and brings the new connection up to the state
+// of the session: it sends the username and our public key, rejoins the
+// rooms we were in, and sends anything typed while offline. All of this is
+// written before the connection is published to other goroutines, so
+// nothing new can overtake it.
+func (s *session) connect() (net.Conn, error) {
+	conn, err := dialWebSocket(s.url, s.proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	var rejoin []event
+	for room := range s.rooms {
+		if room != defaultRoom {
+			rejoin = append(rejoin, event{Type: eventJoin, Room: room})
+		}
+	}
+	if !s.rooms[defaultRoom] {
+		rejoin = append(rejoin, event{Type: eventLeave, Room: defaultRoom})
+	}
+	s.mu.Unlock()
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	frames := [][]byte{[]byte(s.username), encodeEvent(event{Type: eventKey, Key: s.identity.PublicKey().Bytes()})}
+	for _, ev := range rejoin {
+		frames = append(frames, encodeEvent(ev))
+	}
+	for _, ev := range s.outbox {
+		frames = append(frames, encodeEvent(ev))
+	}
+	s.rec.record("connect", 0, []byte(s.url.String()))
+	for _, f := range frames {
+		if err := s.writeFrame(conn, 0x1, f); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	s.outbox = nil
+	s.conn = conn
+	s.readDone = make(chan struct{})
+	s.unanswered = 0
+	return conn, nil
+}
+
+// run reads events from conn until the user quits. Whenever the connection
+// drops it reconnects with backoff and carries on with the new connection.
+func (s *session) run(conn net.Conn) {
+	for conn != nil {
+		err := s.readLoop(conn)
+		s.wmu.Lock()
+		s.conn = nil
+		s.wmu.Unlock()
+		conn.Close()
+		if s.isClosing() {
+			return
+		}
+		s.t.println(fmt.Sprintf("* connection lost (%v)", err))
+		s.t.setConnState("offline")
+		conn = s.reconnect()
+	}
+}
+
+// readLoop hands every event from conn, which must be the connection just
+// made by connect, to receive until the connection fails or the server
+// closes it. It keeps the connection alive meanwhile (see keepalive).
+func (s *session) readLoop(conn net.Conn) error {
+	s.wmu.Lock()
+	done := s.readDone
+	s.wmu.Unlock()
+	defer close(done)
+	go s.keepalive(conn, done)
+
+	for {
+		opcode, payload, err := readWebSocketFrame(conn)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return errNoPong
+		}
+		if err != nil {
+			return err
+		}
+		s.rec.record("recv", opcode, payload)
+		s.wmu.Lock()
+		s.unanswered = 0
+		s.wmu.Unlock()
+		switch opcode {
+		case 0x8:
+			return errors.New("server closed the connection")
+		case 0x9:
+			s.wmu.Lock()
+			s.writeFrame(conn, 0xA, payload)
+			s.wmu.Unlock()
+			continue
+		case 0xA:
+			if len(payload) == 8 {
+				sent := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+				s.t.setLatency(time.Since(sent))
+			}
+			continue
+		}
+		if ev, ok := decodeEvent(payload); ok {
+			s.receive(ev)
+		} else {
+			s.t.println(string(payload))
+		}
+	}
+}
+
+// keepalive pings the server on conn straight away and then every
+// pingInterval until done is closed. Each ping carries the time it was
+// sent, which the pong echoes back for readLoop to work out the round-trip
+// time. Once maxMissedPongs pings have gone unanswered it expires the read
+// deadline, so readLoop fails with errNoPong and the session reconnects.
+func (s *session) keepalive(conn net.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		s.wmu.Lock()
+		if s.unanswered >= maxMissedPongs {
+			s.wmu.Unlock()
+			conn.SetReadDeadline(time.Now())
+			return
+		}
+		s.unanswered++
+		payload := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+		err := s.writeFrame(conn, 0x9, payload)
+		s.wmu.Unlock()
+		if err != nil {
+			return // readLoop will fail too
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconnect retries connect with jittered exponential backoff until it
+// succeeds, or returns nil if the user quits meanwhile.
+func (s *session) reconnect() net.Conn {
+	for attempt := 0; ; attempt++ {
+		delay := backoff(attempt)
+		s.t.println(fmt.Sprintf("* reconnecting in %.1fs (attempt %d)...", delay.Seconds(), attempt+1))
+		s.t.setConnState(fmt.Sprintf("reconnecting (attempt %d)", attempt+1))
+		time.Sleep(delay)
+		if s.isClosing() {
+			return nil
+		}
+		conn, err := s.connect()
+		if err == nil {
+			s.t.println("* reconnected to " + s.url.Host)
+			s.t.setConnState("connected to " + s.url.Host)
+			return conn
+		}
+		s.t.println(fmt.Sprintf("* reconnect failed: %v", err))
+	}
+}
+
+// backoff returns the delay before reconnect attempt n: an exponentially
+// growing ceiling, capped at reconnectMax, of which a random upper half is
+// used.
+func backoff(n int) time.Duration {
+	ceiling := reconnectMax
+	if n < 16 {
+		ceiling = min(reconnectMin<<n, reconnectMax)
+	}
+	return ceiling/2 + rand.N(ceiling/2)
+}
+
+// queue sends an event the user typed. While offline it is held and sent
+// after reconnecting instead.
+func (s *session) queue(ev event) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.conn != nil {
+		if err := s.writeFrame(s.conn, 0x1, encodeEvent(ev)); err == nil {
+			return nil
+		}
+	}
+	if len(s.outbox) >= maxOutbox {
+		return errors.New("offline and the outgoing queue is full; message dropped")
+	}
+	s.outbox = append(s.outbox, ev)
+	s.t.println(fmt.Sprintf("* offline; will send after reconnecting (%d queued)", len(s.outbox)))
+	return nil
+}
+
+func (s *session) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
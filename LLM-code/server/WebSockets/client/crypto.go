@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Private messages are end-to-end encrypted. Each client has a long-term
+// X25519 identity key; the public half is published through the server.
+// A message from A to B is sealed with AES-256-GCM under a key derived by
+// HKDF-SHA256 from the X25519 shared secret of A and B, with the sender
+// and recipient names as associated data. Both sides derive the same key,
+// so the sender can also read its own echo. The keys are static, so there
+// is no forward secrecy: a stolen identity key exposes past messages.
+
+// dmInfo is the HKDF context string; bump it if the scheme ever changes.
+const dmInfo = "websocket-chat dm v1"
+
+// configDir is where the client keeps its identity and pinned keys.
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "websocket-chat"), nil
+}
+
+// loadIdentity reads the X25519 private key stored at path, generating and
+// saving a new one (readable only by the user) if none exists yet.
+func loadIdentity(path string) (*ecdh.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return ecdh.X25519().NewPrivateKey(data)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, key.Bytes(), 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// fingerprint formats the SHA-256 of a public key as eight groups of four
+// hex digits, for users to compare out of band.
+func fingerprint(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	digits := hex.EncodeToString(sum[:16])
+	groups := make([]string, 0, len(digits)/4)
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// dmCipher derives the AEAD shared by the owner of priv and the owner of
+// the public key peer.
+func dmCipher(priv *ecdh.PrivateKey, peer []byte) (cipher.AEAD, error) {
+	peerKey, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := priv.ECDH(peerKey)
+	if err != nil {
+		return nil, err
+	}
+	// Bind the derived key to both public keys, in a fixed order.
+	own := priv.PublicKey().Bytes()
+	first, second := own, peer
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+	info := dmInfo + string(first) + string(second)
+	key, err := hkdf.Key(sha256.New, shared, nil, info, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealDM encrypts a private message from -> to with a fresh random nonce.
+func sealDM(priv *ecdh.PrivateKey, peer []byte, from, to string, plaintext []byte) (nonce, ciphertext []byte, err error) {
+	aead, err := dmCipher(priv, peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, plaintext, dmAAD(from, to)), nil
+}
+
+// openDM decrypts a private message from -> to.
+func openDM(priv *ecdh.PrivateKey, peer []byte, from, to string, nonce, ciphertext []byte) ([]byte, error) {
+	aead, err := dmCipher(priv, peer)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	return aead.Open(nil, nonce, ciphertext, dmAAD(from, to))
+}
+
+func dmAAD(from, to string) []byte {
+	return []byte(from + "\x00" + to)
+}
+
+// keyStatus is the result of checking a user's key against the keyring.
+type keyStatus int
+
+const (
+	keyTrusted keyStatus = iota // matches the pinned key
+	keyNew                      // first key seen for this user; now pinned
+	keyChanged                  // differs from the pinned key
+)
+
+// keyring pins the first public key seen for each user (trust on first
+// use) in a JSON file, so a key swapped by the server or an impostor is
+// noticed instead of silently used.
+type keyring struct {
+	mu     sync.Mutex
+	path   string
+	pinned map[string][]byte
+}
+
+func loadKeyring(path string) (*keyring, error) {
+	k := &keyring{path: path, pinned: make(map[string][]byte)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &k.pinned); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return k, nil
+}
+
+// check compares key with the one pinned for user, pinning it if there is
+// none yet.
+func (k *keyring) check(user string, key []byte) (keyStatus, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	pinned, ok := k.pinned[user]
+	switch {
+	case !ok:
+		k.pinned[user] = key
+		return keyNew, k.save()
+	case bytes.Equal(pinned, key):
+		return keyTrusted, nil
+	default:
+		return keyChanged, nil
+	}
+}
+
+// pin replaces the pinned key for user, after the user accepted a change.
+func (k *keyring) pin(user string, key []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.pinned[user] = key
+	return k.save()
+}
+
+// lookup returns the key pinned for user, or nil.
+func (k *keyring) lookup(user string) []byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.pinned[user]
+}
+
+// save writes the keyring. Callers must hold k.mu.
+func (k *keyring) save() error {
+	if k.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(k.pinned, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(k.path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(k.path, data, 0o600)
+}
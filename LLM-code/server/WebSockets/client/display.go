@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"unicode/utf8"
+)
+
+// maxRewriteDistance is how far up (in terminal rows) lineDisplay will reach
+// to rewrite a line in place. Anything older has most likely scrolled off
+// screen, so the update is printed as a new line instead.
+const maxRewriteDistance = 40
+
+// display shows the lines the transcript renders. lineDisplay prints to a
+// plain terminal; tui keeps them in a scrollable full-screen pane.
+// Implementations are only called with the transcript's lock held.
+type display interface {
+	// add shows a new line at the bottom and returns it, so it can be
+	// redrawn after its text changes.
+	add(text string) *line
+	// redraw shows l again after l.text changed; what describes the change
+	// for displays that can't redraw in place.
+	redraw(l *line, what string)
+	// inputLine records that the terminal echoed a line the user typed.
+	inputLine()
+	// statusBar reports whether the display has a status bar, and status
+	// sets its text.
+	statusBar() bool
+	status(text string)
+}
+
+// line is one entry of the transcript.
+type line struct {
+	text string
+
+	// row and height locate the line on a plain terminal (lineDisplay).
+	row, height int
+}
+
+// lineDisplay prints lines to a plain terminal and remembers on which row
+// each was printed, so changed lines can be rewritten in place using ANSI
+// cursor movement.
+type lineDisplay struct {
+	out   io.Writer
+	width int
+	rows  int // rows written so far, including echoed user input
+}
+
+func newLineDisplay(out io.Writer) *lineDisplay {
+	width, _ := strconv.Atoi(os.Getenv("COLUMNS"))
+	if width <= 0 {
+		width = 80
+	}
+	return &lineDisplay{out: out, width: width}
+}
+
+func (d *lineDisplay) add(text string) *line {
+	fmt.Fprintln(d.out, text)
+	l := &line{text: text, row: d.rows, height: d.height(text)}
+	d.rows += l.height
+	return l
+}
+
+func (d *lineDisplay) redraw(l *line, what string) {
+	distance := d.rows - l.row
+	if distance > maxRewriteDistance || d.height(l.text) != l.height {
+		d.add(fmt.Sprintf("* %s: %s", what, l.text))
+		return
+	}
+	// Save cursor, move up to the line, clear and reprint it, restore.
+	fmt.Fprintf(d.out, "\x1b7\x1b[%dA\r\x1b[2K%s\x1b8", distance, l.text)
+}
+
+func (d *lineDisplay) inputLine() { d.rows++ }
+
+func (d *lineDisplay) statusBar() bool { return false }
+
+func (d *lineDisplay) status(string) {}
+
+func (d *lineDisplay) height(s string) int {
+	n := utf8.RuneCountInString(s)
+	if n == 0 {
+		return 1
+	}
+	return (n + d.width - 1) / d.width
+}
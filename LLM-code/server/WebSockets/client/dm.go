@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// receive handles an event from the server: room membership is tracked for
+// reconnects, key exchange and decryption happen here, and everything is
+// then rendered by the transcript.
+func (s *session) receive(ev event) {
+	switch ev.Type {
+	case eventKey:
+		s.acceptKey(ev.From, ev.Key)
+		return
+	case eventJoin, eventLeave:
+		if ev.From == s.self {
+			s.mu.Lock()
+			if ev.Type == eventJoin {
+				s.rooms[ev.Room] = true
+			} else {
+				delete(s.rooms, ev.Room)
+			}
+			s.mu.Unlock()
+		}
+	case eventPrivate:
+		ev.Text = s.decrypt(ev)
+	case eventError:
+		if ev.To != "" {
+			s.dropPending(html.EscapeString(ev.To))
+		}
+	}
+	if err := s.history.record(ev); err != nil {
+		s.t.println(fmt.Sprintf("Warning: could not save history (%v)", err))
+	}
+	if s.observe != nil {
+		s.observe(ev)
+	}
+	s.t.render(ev)
+}
+
+// privateMessage encrypts text for user to. If we don't have their key yet
+// the message is held and a key request is returned instead; it is sent
+// once the key arrives.
+//
+// The server HTML-escapes usernames, so names are kept escaped here (that is
+// how they appear in events and the associated data) and unescaped only in
+// the To field we send, which the server escapes again.
+func (s *session) privateMessage(to, text string) (event, error) {
+	to = html.EscapeString(strings.TrimSpace(to))
+	s.mu.Lock()
+	peer, ok := s.peerKeys[to]
+	if !ok {
+		s.pending[to] = append(s.pending[to], text)
+		s.mu.Unlock()
+		return event{Type: eventKeyReq, To: html.UnescapeString(to)}, nil
+	}
+	s.mu.Unlock()
+	return s.seal(to, peer, text)
+}
+
+func (s *session) seal(to string, peer []byte, text string) (event, error) {
+	nonce, ct, err := sealDM(s.identity, peer, s.self, to, []byte(text))
+	if err != nil {
+		return event{}, err
+	}
+	return event{
+		Type:       eventPrivate,
+		To:         html.UnescapeString(to),
+		Key:        s.identity.PublicKey().Bytes(),
+		Nonce:      nonce,
+		Ciphertext: ct,
+	}, nil
+}
+
+// acceptKey checks a key the server sent for user against the keyring and,
+// if it can be used, sends any private messages waiting for it.
+func (s *session) acceptKey(user string, key []byte) {
+	status, err := s.keys.check(user, key)
+	if err != nil {
+		s.t.println("! saving pinned key: " + err.Error())
+	}
+	switch status {
+	case keyNew:
+		s.t.println(fmt.Sprintf("* %s's key fingerprint is %s; compare it with them to be sure", user, fingerprint(key)))
+	case keyChanged:
+		s.mu.Lock()
+		s.offered[user] = key
+		held := len(s.pending[user])
+		s.mu.Unlock()
+		s.t.println(fmt.Sprintf("! WARNING: %s's key has changed (new fingerprint %s). %d message(s) held; "+
+			"verify the fingerprint with them, then /trust %s", user, fingerprint(key), held, user))
+		return
+	}
+	s.mu.Lock()
+	s.peerKeys[user] = key
+	s.mu.Unlock()
+	s.flushPending(user)
+}
+
+// trust accepts a changed key for user after the user verified it.
+func (s *session) trust(user string) error {
+	user = html.EscapeString(strings.TrimSpace(user))
+	s.mu.Lock()
+	key, ok := s.offered[user]
+	delete(s.offered, user)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no changed key waiting for %q", user)
+	}
+	if err := s.keys.pin(user, key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.peerKeys[user] = key
+	s.mu.Unlock()
+	s.t.println(fmt.Sprintf("* now trusting %s's key %s", user, fingerprint(key)))
+	s.flushPending(user)
+	return nil
+}
+
+// showFingerprint prints our own fingerprint, or the one pinned for user.
+func (s *session) showFingerprint(user string) error {
+	if user == "" {
+		s.t.println("* your key fingerprint is " + fingerprint(s.identity.PublicKey().Bytes()))
+		return nil
+	}
+	user = html.EscapeString(user)
+	key := s.keys.lookup(user)
+	if key == nil {
+		return fmt.Errorf("no key known for %q yet; send them a message first", user)
+	}
+	s.t.println(fmt.Sprintf("* %s's key fingerprint is %s", user, fingerprint(key)))
+	return nil
+}
+
+// flushPending encrypts and sends the messages held for user.
+func (s *session) flushPending(user string) {
+	s.mu.Lock()
+	texts := s.pending[user]
+	delete(s.pending, user)
+	peer := s.peerKeys[user]
+	s.mu.Unlock()
+	for _, text := range texts {
+		ev, err := s.seal(user, peer, text)
+		if err == nil {
+			err = s.send(ev)
+		}
+		if err != nil {
+			s.t.println("! sending private message: " + err.Error())
+			return
+		}
+	}
+}
+
+// dropPending discards messages held for user after the server reported
+// that it can't provide their key.
+func (s *session) dropPending(user string) {
+	s.mu.Lock()
+	n := len(s.pending[user])
+	delete(s.pending, user)
+	s.mu.Unlock()
+	if n > 0 {
+		s.t.println(fmt.Sprintf("! %d private message(s) to %s not sent", n, user))
+	}
+}
+
+// decrypt returns the plaintext of a private message, or a placeholder
+// explaining why it can't be shown.
+func (s *session) decrypt(ev event) string {
+	var peer []byte
+	if ev.From == s.self {
+		// Our own message echoed back: the other party is the recipient.
+		s.mu.Lock()
+		peer = s.peerKeys[ev.To]
+		s.mu.Unlock()
+	} else {
+		status, err := s.keys.check(ev.From, ev.Key)
+		if err != nil {
+			s.t.println("! saving pinned key: " + err.Error())
+		}
+		switch status {
+		case keyNew:
+			s.t.println(fmt.Sprintf("* %s's key fingerprint is %s; compare it with them to be sure", ev.From, fingerprint(ev.Key)))
+		case keyChanged:
+			s.mu.Lock()
+			s.offered[ev.From] = ev.Key
+			s.mu.Unlock()
+			return fmt.Sprintf("(not shown: %s's key changed to %s; verify it, then /trust %s)", ev.From, fingerprint(ev.Key), ev.From)
+		}
+		peer = ev.Key
+	}
+	if peer == nil {
+		return "(encrypted message)"
+	}
+	plain, err := openDM(s.identity, peer, ev.From, ev.To, ev.Nonce, ev.Ciphertext)
+	if err != nil {
+		return "(could not decrypt message)"
+	}
+	return string(plain)
+}
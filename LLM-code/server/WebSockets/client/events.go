@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Event types exchanged with the server after the username handshake.
+// These mirror the definitions in the server.
+const (
+	eventMessage   = "message"
+	eventEdit      = "edit"
+	eventDelete    = "delete"
+	eventReact     = "react"
+	eventReactions = "reactions"
+	eventError     = "error"
+	eventJoin      = "join"
+	eventLeave     = "leave"
+	eventTyping    = "typing"
+	eventRead      = "read"
+	eventPrivate   = "private"
+	eventNotice    = "notice"
+	eventKey       = "key"
+	eventKeyReq    = "key_request"
+)
+
+// defaultRoom is the room the server places every client in on connect.
+const defaultRoom = "lobby"
+
+// event is the JSON envelope for every frame after the username.
+type event struct {
+	Type      string         `json:"type"`
+	ID        string         `json:"id,omitempty"`
+	Room      string         `json:"room,omitempty"`
+	From      string         `json:"from,omitempty"`
+	To        string         `json:"to,omitempty"`
+	Text      string         `json:"text,omitempty"`
+	Emoji     string         `json:"emoji,omitempty"`
+	Reactions map[string]int `json:"reactions,omitempty"`
+	Edited    bool           `json:"edited,omitempty"`
+	Time      time.Time      `json:"time,omitzero"`
+	Offline   bool           `json:"offline,omitempty"`
+
+	// Encrypted private messages; see crypto.go.
+	Key        []byte `json:"key,omitempty"`
+	Nonce      []byte `json:"nonce,omitempty"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+}
+
+// decodeEvent parses a frame from the server. Servers that predate the
+// JSON protocol send bare text, which is returned as ok == false.
+func decodeEvent(payload []byte) (ev event, ok bool) {
+	if err := json.Unmarshal(payload, &ev); err != nil || ev.Type == "" {
+		return event{}, false
+	}
+	return ev, true
+}
+
+// encodeEvent marshals an event for sending.
+func encodeEvent(ev event) []byte {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
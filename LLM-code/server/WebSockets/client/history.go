@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The client keeps a local history of the room messages it receives, so
+// that lines which have scrolled away can be found again with /history and
+// /search, and a room exported with /export. Each server has a directory
+// under "history" in the config directory, with a file of JSON lines per
+// room:
+//
+//	websocket-chat/history/127.0.0.1_8080/lobby.jsonl
+//
+// Edits and deletes are appended as they arrive and applied when a file is
+// read back. Private messages are not kept, so they are never stored in the
+// clear. -history=false turns the history off.
+
+// historyFileExt is the extension of the per-room history files.
+const historyFileExt = ".jsonl"
+
+// history stores the room messages received from one server. A nil
+// history stores nothing.
+type history struct {
+	mu       sync.Mutex
+	dir      string
+	reported bool // a write error has been returned by record
+}
+
+// openHistory creates, if needed, the history directory for server
+// (host:port). History holds message contents, so only the user can read
+// it.
+func openHistory(server string) (*history, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Join(dir, "history", safeFileName(server))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &history{dir: dir}, nil
+}
+
+// safeFileName replaces everything but letters, digits, '.', '-' and '_'
+// in name with '_'. Room names are already restricted like this by the
+// server, and host:port only needs its colon replaced.
+func safeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func (h *history) path(room string) string {
+	return filepath.Join(h.dir, safeFileName(room)+historyFileExt)
+}
+
+// record appends a room message, edit or delete to the room's file. Other
+// events are ignored. Only the first write error is returned, so a full
+// disk is reported once rather than for every message.
+func (h *history) record(ev event) error {
+	if h == nil || ev.Room == "" {
+		return nil
+	}
+	switch ev.Type {
+	case eventMessage, eventEdit, eventDelete:
+	default:
+		return nil
+	}
+	entry := event{Type: ev.Type, ID: ev.ID, Room: ev.Room, From: ev.From, Text: ev.Text, Edited: ev.Edited, Time: ev.Time}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.OpenFile(h.path(ev.Room), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err == nil {
+		_, err = f.Write(append(encodeEvent(entry), '\n'))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil || h.reported {
+		return nil
+	}
+	h.reported = true
+	return err
+}
+
+// load returns the messages kept for room, oldest first, with edits and
+// deletes applied.
+func (h *history) load(room string) ([]event, error) {
+	if h == nil {
+		return nil, errors.New("history is turned off")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.Open(h.path(room))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var msgs []event
+	index := make(map[string]int) // message ID -> position in msgs
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		ev, ok := decodeEvent(scanner.Bytes())
+		if !ok {
+			continue // a line cut short by a crash
+		}
+		i, seen := index[ev.ID]
+		switch {
+		case ev.Type == eventMessage && !seen:
+			index[ev.ID] = len(msgs)
+			msgs = append(msgs, ev)
+		case ev.Type == eventEdit && seen:
+			msgs[i].Text, msgs[i].Edited = ev.Text, true
+		case ev.Type == eventDelete && seen:
+			msgs[i].Type = eventDelete
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(msgs, func(m event) bool { return m.Type == eventDelete }), nil
+}
+
+// rooms returns the rooms with a history file, sorted by name.
+func (h *history) rooms() ([]string, error) {
+	if h == nil {
+		return nil, errors.New("history is turned off")
+	}
+	files, err := filepath.Glob(filepath.Join(h.dir, "*"+historyFileExt))
+	if err != nil {
+		return nil, err
+	}
+	rooms := make([]string, len(files))
+	for i, f := range files {
+		rooms[i] = strings.TrimSuffix(filepath.Base(f), historyFileExt)
+	}
+	return rooms, nil
+}
+
+// search returns the messages in any room whose text or sender contains
+// text, ignoring case, oldest first.
+func (h *history) search(text string) ([]event, error) {
+	rooms, err := h.rooms()
+	if err != nil {
+		return nil, err
+	}
+	text = strings.ToLower(text)
+	var found []event
+	for _, room := range rooms {
+		msgs, err := h.load(room)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if strings.Contains(strings.ToLower(m.Text), text) || strings.Contains(strings.ToLower(m.From), text) {
+				found = append(found, m)
+			}
+		}
+	}
+	slices.SortStableFunc(found, func(a, b event) int { return a.Time.Compare(b.Time) })
+	return found, nil
+}
+
+// formatHistory renders a stored message as a line for /history and
+// /search, e.g. "Oct 18 13:27 #lobby alice: hello (edited)".
+func formatHistory(m event, withRoom bool) string {
+	var b strings.Builder
+	b.WriteString(m.Time.Local().Format("Jan 2 15:04"))
+	if withRoom {
+		fmt.Fprintf(&b, " #%s", m.Room)
+	}
+	fmt.Fprintf(&b, " %s: %s", m.From, m.Text)
+	if m.Edited {
+		b.WriteString(" (edited)")
+	}
+	return b.String()
+}
+
+// Formats /export can write.
+const (
+	exportMarkdown = "markdown"
+	exportJSON     = "json"
+)
+
+// exportFormat accepts the names and extensions of the export formats.
+func exportFormat(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "markdown", "md":
+		return exportMarkdown, nil
+	case "json":
+		return exportJSON, nil
+	}
+	return "", fmt.Errorf("unknown export format %q (want markdown or json)", name)
+}
+
+// markdownEscaper escapes the characters that would otherwise format a
+// message's text in Markdown.
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`,
+	"<", `\<`, ">", `\>`, "#", `\#`, "|", `\|`, "~", `\~`,
+)
+
+// exportTranscript writes the messages of room on server to w in format.
+// Markdown is meant for reading, with a heading per day; JSON is an array
+// of the stored message events.
+func exportTranscript(w io.Writer, format, server, room string, msgs []event) error {
+	if format == exportJSON {
+		if msgs == nil {
+			msgs = []event{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(msgs)
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# #%s on %s\n", room, server)
+	var day string
+	for _, m := range msgs {
+		t := m.Time.Local()
+		if d := t.Format("Monday, January 2, 2006"); d != day {
+			day = d
+			fmt.Fprintf(bw, "\n## %s\n\n", day)
+		}
+		fmt.Fprintf(bw, "- %s **%s**: %s", t.Format("15:04"), markdownEscaper.Replace(m.From), markdownEscaper.Replace(m.Text))
+		if m.Edited {
+			bw.WriteString(" _(edited)_")
+		}
+		bw.WriteString("\n")
+	}
+	return bw.Flush()
+}
+
+// Defaults for /history and /search.
+const (
+	defaultHistoryLines = 20
+	maxSearchResults    = 50
+)
+
+// showHistory prints the last n messages kept for the current room.
+func (s *session) showHistory(arg string) error {
+	n := defaultHistoryLines
+	if arg != "" {
+		var err error
+		if n, err = strconv.Atoi(arg); err != nil || n <= 0 {
+			return errors.New("usage: /history [n]")
+		}
+	}
+	room := s.currentRoom()
+	msgs, err := s.history.load(room)
+	if err != nil {
+		return err
+	}
+	if len(msgs) == 0 {
+		s.t.println(fmt.Sprintf("* no history for #%s", room))
+		return nil
+	}
+	msgs = msgs[max(0, len(msgs)-n):]
+	s.t.println(fmt.Sprintf("* last %d messages in #%s:", len(msgs), room))
+	for _, m := range msgs {
+		s.t.println("  " + formatHistory(m, false))
+	}
+	return nil
+}
+
+// searchHistory prints the most recent messages from any room on this
+// server matching text.
+func (s *session) searchHistory(text string) error {
+	if text == "" {
+		return errors.New("usage: /search <text>")
+	}
+	found, err := s.history.search(text)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(found) == 0:
+		s.t.println(fmt.Sprintf("* no messages match %q", text))
+		return nil
+	case len(found) > maxSearchResults:
+		s.t.println(fmt.Sprintf("* %d messages match %q; the last %d:", len(found), text, maxSearchResults))
+		found = found[len(found)-maxSearchResults:]
+	default:
+		s.t.println(fmt.Sprintf("* %d messages match %q:", len(found), text))
+	}
+	for _, m := range found {
+		s.t.println("  " + formatHistory(m, true))
+	}
+	return nil
+}
+
+// exportHistory writes the current room's history to path, by default
+// "<room>.md" or "<room>.json" in the working directory.
+func (s *session) exportHistory(formatName, path string) error {
+	if formatName == "" {
+		return errors.New("usage: /export <markdown|json> [file]")
+	}
+	format, err := exportFormat(formatName)
+	if err != nil {
+		return err
+	}
+	room := s.currentRoom()
+	if path == "" {
+		path = safeFileName(room) + ".md"
+		if format == exportJSON {
+			path = safeFileName(room) + ".json"
+		}
+	}
+	msgs, err := s.history.load(room)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := exportTranscript(f, format, s.url.Host, room, msgs); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.t.println(fmt.Sprintf("* exported %d messages from #%s to %s", len(msgs), room, path))
+	return nil
+}
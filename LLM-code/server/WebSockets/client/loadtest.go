@@ -0,0 +1,403 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// joinTimeout is how long a load client waits for the server to confirm it
+// joined the test room.
+const joinTimeout = 10 * time.Second
+
+// drainTimeout is how long the load test waits, after the last message is
+// sent, for deliveries still in flight.
+const drainTimeout = 5 * time.Second
+
+// loadPrefix starts the text of every load test message, followed by the
+// run's ID and the send time in Unix nanoseconds. Only messages with this
+// run's ID are counted, so other users of the room, or another load test
+// running at the same time, don't skew the results.
+const loadPrefix = "loadtest "
+
+// runLoadTest implements "client loadtest [flags]". It opens -clients
+// connections, spread over -ramp-up, joins them all to one room, then for
+// -duration sends messages from each client in turn at -rate per second
+// in total. Every client measures the time from send to delivery of every
+// broadcast it receives, so the latency covers the whole path through the
+// server's hub. It prints a report as text or JSON and returns the exit
+// code.
+func runLoadTest(args []string) int {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	addr := fs.String("addr", cmp.Or(os.Getenv("CHAT_ADDR"), defaultAddr), "server address as host:port (env CHAT_ADDR)")
+	useTLS := fs.Bool("tls", false, "connect over TLS (wss://)")
+	clients := fs.Int("clients", 50, "number of concurrent connections")
+	rampUp := fs.Duration("ramp-up", 5*time.Second, "time over which connections are opened")
+	rate := fs.Float64("rate", 10, "messages per second, across all clients")
+	duration := fs.Duration("duration", 30*time.Second, "how long to send messages once all clients are connected")
+	size := fs.Int("size", 64, "bytes of padding in each message")
+	room := fs.String("room", "loadtest", "room the clients join")
+	format := fs.String("format", "text", "report format: text or json")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	switch {
+	case *clients < 1:
+		fmt.Fprintln(os.Stderr, "-clients must be at least 1")
+		return exitUsage
+	case *rate <= 0 || *duration <= 0 || *rampUp < 0 || *size < 0:
+		fmt.Fprintln(os.Stderr, "-rate and -duration must be positive, -ramp-up and -size not negative")
+		return exitUsage
+	case *format != "text" && *format != "json":
+		fmt.Fprintln(os.Stderr, "-format must be text or json")
+		return exitUsage
+	}
+
+	u := url.URL{Scheme: "ws", Host: *addr, Path: "/ws"}
+	if *useTLS {
+		u.Scheme = "wss"
+	}
+	proxy, err := proxyFromEnvironment(u, os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	var id [6]byte
+	rand.Read(id[:])
+	lt := &loadTest{
+		url:     u,
+		proxy:   proxy,
+		room:    *room,
+		id:      hex.EncodeToString(id[:]),
+		padding: strings.Repeat("x", *size),
+	}
+	lt.run(*clients, *rampUp, *rate, *duration)
+	report := lt.report(*clients, *rate)
+
+	if *format == "json" {
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		out.Encode(report)
+	} else {
+		report.print(os.Stdout)
+	}
+	if report.Connected == 0 {
+		return exitConnect
+	}
+	return exitOK
+}
+
+// loadTest holds the state of one load test run.
+type loadTest struct {
+	url     url.URL
+	proxy   *url.URL
+	room    string
+	id      string // random, to tell this run's users and messages apart
+	padding string
+
+	mu        sync.Mutex
+	live      []*loadClient // joined and not disconnected
+	latencies []time.Duration
+	stopping  bool
+
+	connected     atomic.Int64
+	connectErrors atomic.Int64
+	disconnects   atomic.Int64
+	sent          atomic.Int64
+	sendErrors    atomic.Int64
+	serverErrors  atomic.Int64
+	expected      atomic.Int64 // deliveries expected: live clients at each send
+	received      atomic.Int64
+	sendTime      time.Duration // how long sending actually took
+}
+
+// loadClient is one simulated user.
+type loadClient struct {
+	name   string
+	conn   net.Conn
+	wmu    sync.Mutex
+	joined chan struct{} // closed when the server confirms the join
+	done   chan struct{} // closed when the connection ends
+}
+
+func (c *loadClient) send(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return writeWebSocketFrame(c.conn, opcode, payload)
+}
+
+// run connects the clients, sends messages for duration, waits for the
+// last deliveries and disconnects everyone.
+func (lt *loadTest) run(clients int, rampUp time.Duration, rate float64, duration time.Duration) {
+	prefix := "load-" + lt.id[:6] + "-"
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Until(start.Add(rampUp * time.Duration(i) / time.Duration(clients))))
+			if err := lt.connect(prefix + strconv.Itoa(i)); err != nil {
+				lt.connectErrors.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if lt.connected.Load() == 0 {
+		return
+	}
+
+	interval := time.Duration(float64(time.Second) / rate)
+	ticker := time.NewTicker(max(interval, time.Microsecond))
+	end := time.After(duration)
+	sendStart := time.Now()
+	for n, sending := 0, true; sending; n++ {
+		select {
+		case <-ticker.C:
+			lt.sendOne(n)
+		case <-end:
+			sending = false
+		}
+	}
+	ticker.Stop()
+	lt.sendTime = time.Since(sendStart)
+
+	deadline := time.Now().Add(drainTimeout)
+	for lt.received.Load() < lt.expected.Load() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lt.mu.Lock()
+	lt.stopping = true
+	live := lt.live
+	lt.live = nil
+	lt.mu.Unlock()
+	for _, c := range live {
+		c.send(0x8, nil)
+		c.conn.Close()
+	}
+}
+
+// connect opens one connection and waits until it has joined the room.
+func (lt *loadTest) connect(name string) error {
+	conn, err := dialWebSocket(lt.url, lt.proxy)
+	if err != nil {
+		return err
+	}
+	c := &loadClient{name: name, conn: conn, joined: make(chan struct{}), done: make(chan struct{})}
+	frames := [][]byte{
+		[]byte(name),
+		encodeEvent(event{Type: eventJoin, Room: lt.room}),
+		encodeEvent(event{Type: eventLeave, Room: defaultRoom}),
+	}
+	for _, f := range frames {
+		if err := c.send(0x1, f); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	go lt.readLoop(c)
+
+	select {
+	case <-c.joined:
+	case <-c.done:
+		conn.Close()
+		return errors.New("connection closed before joining the room")
+	case <-time.After(joinTimeout):
+		conn.Close()
+		return errors.New("timed out joining the room")
+	}
+	lt.connected.Add(1)
+	lt.mu.Lock()
+	lt.live = append(lt.live, c)
+	lt.mu.Unlock()
+	return nil
+}
+
+// readLoop records the latency of every load test message c receives.
+func (lt *loadTest) readLoop(c *loadClient) {
+	joined := false
+	defer func() {
+		close(c.done)
+		lt.mu.Lock()
+		defer lt.mu.Unlock()
+		if joined && !lt.stopping {
+			lt.disconnects.Add(1)
+			lt.live = slices.DeleteFunc(lt.live, func(l *loadClient) bool { return l == c })
+		}
+	}()
+	for {
+		opcode, payload, err := readWebSocketFrame(c.conn)
+		if err != nil || opcode == 0x8 {
+			return
+		}
+		ev, ok := decodeEvent(payload)
+		if !ok {
+			continue
+		}
+		switch ev.Type {
+		case eventJoin:
+			if !joined && ev.From == c.name && ev.Room == lt.room {
+				joined = true
+				close(c.joined)
+			}
+		case eventMessage:
+			rest, ok := strings.CutPrefix(ev.Text, lt.textPrefix())
+			if !ok {
+				continue
+			}
+			ts, _, _ := strings.Cut(rest, " ")
+			nanos, err := strconv.ParseInt(ts, 10, 64)
+			if err != nil {
+				continue
+			}
+			latency := time.Since(time.Unix(0, nanos))
+			lt.received.Add(1)
+			lt.mu.Lock()
+			lt.latencies = append(lt.latencies, latency)
+			lt.mu.Unlock()
+		case eventError:
+			lt.serverErrors.Add(1)
+		}
+	}
+}
+
+// textPrefix returns what this run's messages start with.
+func (lt *loadTest) textPrefix() string {
+	return loadPrefix + lt.id + " "
+}
+
+// sendOne sends message n from one of the live clients, in turn.
+func (lt *loadTest) sendOne(n int) {
+	lt.mu.Lock()
+	if len(lt.live) == 0 {
+		lt.mu.Unlock()
+		return
+	}
+	c := lt.live[n%len(lt.live)]
+	members := len(lt.live)
+	lt.mu.Unlock()
+
+	text := lt.textPrefix() + strconv.FormatInt(time.Now().UnixNano(), 10) + " " + lt.padding
+	if err := c.send(0x1, encodeEvent(event{Type: eventMessage, Room: lt.room, Text: text})); err != nil {
+		lt.sendErrors.Add(1)
+		return
+	}
+	lt.sent.Add(1)
+	lt.expected.Add(int64(members))
+}
+
+// loadReport is the result of a load test. Latencies are in milliseconds
+// and rates per second.
+type loadReport struct {
+	URL           string       `json:"url"`
+	Room          string       `json:"room"`
+	Clients       int          `json:"clients"`
+	Connected     int64        `json:"connected"`
+	ConnectErrors int64        `json:"connect_errors"`
+	Disconnects   int64        `json:"disconnects"`
+	TargetRate    float64      `json:"target_rate"`
+	Seconds       float64      `json:"seconds"`
+	Sent          int64        `json:"messages_sent"`
+	SendRate      float64      `json:"send_rate"`
+	SendErrors    int64        `json:"send_errors"`
+	ServerErrors  int64        `json:"server_errors"`
+	Expected      int64        `json:"deliveries_expected"`
+	Received      int64        `json:"deliveries_received"`
+	DeliveryRate  float64      `json:"delivery_rate"`
+	Latency       latencyStats `json:"latency_ms"`
+}
+
+type latencyStats struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+func (lt *loadTest) report(clients int, rate float64) loadReport {
+	lt.mu.Lock()
+	latencies := slices.Clone(lt.latencies)
+	lt.mu.Unlock()
+	slices.Sort(latencies)
+
+	seconds := lt.sendTime.Seconds()
+	r := loadReport{
+		URL:           lt.url.String(),
+		Room:          lt.room,
+		Clients:       clients,
+		Connected:     lt.connected.Load(),
+		ConnectErrors: lt.connectErrors.Load(),
+		Disconnects:   lt.disconnects.Load(),
+		TargetRate:    rate,
+		Seconds:       seconds,
+		Sent:          lt.sent.Load(),
+		SendErrors:    lt.sendErrors.Load(),
+		ServerErrors:  lt.serverErrors.Load(),
+		Expected:      lt.expected.Load(),
+		Received:      lt.received.Load(),
+	}
+	if seconds > 0 {
+		r.SendRate = float64(r.Sent) / seconds
+		r.DeliveryRate = float64(r.Received) / seconds
+	}
+	if len(latencies) > 0 {
+		var total time.Duration
+		for _, l := range latencies {
+			total += l
+		}
+		r.Latency = latencyStats{
+			Min:  ms(latencies[0]),
+			Mean: ms(total / time.Duration(len(latencies))),
+			P50:  ms(percentile(latencies, 50)),
+			P90:  ms(percentile(latencies, 90)),
+			P99:  ms(percentile(latencies, 99)),
+			Max:  ms(latencies[len(latencies)-1]),
+		}
+	}
+	return r
+}
+
+// percentile returns the p-th percentile of sorted, by the nearest-rank
+// method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank-1, 0)]
+}
+
+func ms(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Millisecond)*1000) / 1000
+}
+
+func (r loadReport) print(w io.Writer) {
+	fmt.Fprintf(w, "Load test of %s, room #%s\n", r.URL, r.Room)
+	fmt.Fprintf(w, "Connections: %d of %d established, %d failed, %d dropped\n",
+		r.Connected, r.Clients, r.ConnectErrors, r.Disconnects)
+	fmt.Fprintf(w, "Messages:    %d sent in %.1fs (%.1f/s, target %.1f/s), %d send errors, %d server errors\n",
+		r.Sent, r.Seconds, r.SendRate, r.TargetRate, r.SendErrors, r.ServerErrors)
+	fmt.Fprintf(w, "Deliveries:  %d of %d expected (%.1f/s)\n", r.Received, r.Expected, r.DeliveryRate)
+	if r.Received > 0 {
+		l := r.Latency
+		fmt.Fprintf(w, "Latency:     min %.2fms  mean %.2fms  p50 %.2fms  p90 %.2fms  p99 %.2fms  max %.2fms\n",
+			l.Min, l.Mean, l.P50, l.P90, l.P99, l.Max)
+	}
+}
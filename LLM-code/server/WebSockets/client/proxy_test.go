@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// fakeProxy listens on a local port and runs serve on the first
+// connection. It returns the proxy URL for scheme, with user if non-nil.
+func fakeProxy(t *testing.T, scheme string, user *url.Userinfo, serve func(t *testing.T, conn net.Conn)) *url.URL {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		ln.Close()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(t, conn)
+	}()
+	return &url.URL{Scheme: scheme, User: user, Host: ln.Addr().String()}
+}
+
+// echoGreeting checks that the tunnel carries data both ways: it expects
+// "ping" and answers "pong".
+func echoGreeting(t *testing.T, r io.Reader, w io.Writer) {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Errorf("tunnel read: %v", err)
+		return
+	}
+	if string(buf) != "ping" {
+		t.Errorf("tunnel got %q, want %q", buf, "ping")
+	}
+	w.Write([]byte("pong"))
+}
+
+func checkTunnel(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "pong" {
+		t.Fatalf("tunnel returned %q, want %q", buf, "pong")
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     *url.Userinfo
+		wantAuth string
+	}{
+		{"no auth", nil, ""},
+		{"basic auth", url.UserPassword("alice", "s3cret"), "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:s3cret"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := fakeProxy(t, "http", tt.user, func(t *testing.T, conn net.Conn) {
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					t.Errorf("reading CONNECT: %v", err)
+					return
+				}
+				if req.Method != http.MethodConnect || req.Host != "chat.example.com:443" {
+					t.Errorf("got %s %s, want CONNECT chat.example.com:443", req.Method, req.Host)
+				}
+				if got := req.Header.Get("Proxy-Authorization"); got != tt.wantAuth {
+					t.Errorf("Proxy-Authorization = %q, want %q", got, tt.wantAuth)
+				}
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				echoGreeting(t, br, conn)
+			})
+			conn, err := dialProxy(proxy, "chat.example.com:443")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTunnel(t, conn)
+		})
+	}
+}
+
+func TestHTTPConnectRefused(t *testing.T) {
+	proxy := fakeProxy(t, "http", nil, func(t *testing.T, conn net.Conn) {
+		http.ReadRequest(bufio.NewReader(conn))
+		conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n"))
+	})
+	conn, err := dialProxy(proxy, "chat.example.com:443")
+	if err == nil {
+		conn.Close()
+		t.Fatal("dialProxy succeeded, want an error")
+	}
+	if !strings.Contains(err.Error(), "407") {
+		t.Errorf("error %q does not mention the status", err)
+	}
+}
+
+// socksServer is the proxy side of a SOCKS5 handshake. It accepts the
+// methods the client offers that match user (password authentication if
+// set), checks the CONNECT request against wantReq and answers with
+// status.
+func socksServer(user *url.Userinfo, wantReq []byte, status byte) func(t *testing.T, conn net.Conn) {
+	return func(t *testing.T, conn net.Conn) {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			t.Errorf("reading greeting: %v", err)
+			return
+		}
+		methods := make([]byte, header[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			t.Errorf("reading methods: %v", err)
+			return
+		}
+		if user == nil {
+			conn.Write([]byte{socksVersion, socksNoAuth})
+		} else {
+			if !bytes.Contains(methods, []byte{socksPasswordAuth}) {
+				t.Errorf("client offered %v, want password authentication", methods)
+				conn.Write([]byte{socksVersion, socksNoAcceptable})
+				return
+			}
+			conn.Write([]byte{socksVersion, socksPasswordAuth})
+			password, _ := user.Password()
+			want := append([]byte{1, byte(len(user.Username()))}, user.Username()...)
+			want = append(append(want, byte(len(password))), password...)
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("authentication = %v (%v), want %v", got, err, want)
+				conn.Write([]byte{1, 1})
+				return
+			}
+			conn.Write([]byte{1, 0})
+		}
+
+		req := make([]byte, len(wantReq))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			t.Errorf("reading CONNECT: %v", err)
+			return
+		}
+		if !bytes.Equal(req, wantReq) {
+			t.Errorf("CONNECT request = %v, want %v", req, wantReq)
+		}
+		conn.Write([]byte{socksVersion, status, 0, socksIPv4, 127, 0, 0, 1, 0x1f, 0x90})
+		if status == 0 {
+			echoGreeting(t, conn, conn)
+		}
+	}
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	domainReq := append([]byte{socksVersion, socksConnect, 0, socksDomain, 16}, "chat.example.com"...)
+	domainReq = append(domainReq, 0x01, 0xbb)
+	ipReq := []byte{socksVersion, socksConnect, 0, socksIPv4, 10, 0, 0, 1, 0x1f, 0x90}
+
+	tests := []struct {
+		name    string
+		scheme  string
+		user    *url.Userinfo
+		addr    string
+		wantReq []byte
+	}{
+		{"no auth, remote DNS", "socks5h", nil, "chat.example.com:443", domainReq},
+		{"no auth, IP address", "socks5", nil, "10.0.0.1:8080", ipReq},
+		{"username and password", "socks5h", url.UserPassword("alice", "s3cret"), "chat.example.com:443", domainReq},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := fakeProxy(t, tt.scheme, tt.user, socksServer(tt.user, tt.wantReq, 0))
+			conn, err := dialProxy(proxy, tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTunnel(t, conn)
+		})
+	}
+}
+
+func TestSOCKS5ConnectFailure(t *testing.T) {
+	ipReq := []byte{socksVersion, socksConnect, 0, socksIPv4, 10, 0, 0, 1, 0x1f, 0x90}
+	proxy := fakeProxy(t, "socks5", nil, socksServer(nil, ipReq, 5))
+	conn, err := dialProxy(proxy, "10.0.0.1:8080")
+	if err == nil {
+		conn.Close()
+		t.Fatal("dialProxy succeeded, want an error")
+	}
+	if !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("error %q does not describe reply code 5", err)
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		env    map[string]string
+		want   string // "" for a direct connection
+	}{
+		{"nothing set", "wss://chat.example.com", nil, ""},
+		{"HTTPS_PROXY for wss", "wss://chat.example.com", map[string]string{"HTTPS_PROXY": "http://proxy:3128", "HTTP_PROXY": "http://other:3128"}, "http://proxy:3128"},
+		{"HTTP_PROXY for ws", "ws://chat.example.com", map[string]string{"HTTPS_PROXY": "http://proxy:3128", "HTTP_PROXY": "http://other:3128"}, "http://other:3128"},
+		{"lower case", "wss://chat.example.com", map[string]string{"https_proxy": "proxy:3128"}, "http://proxy:3128"},
+		{"ALL_PROXY fallback", "wss://chat.example.com", map[string]string{"ALL_PROXY": "socks5h://proxy:1080"}, "socks5h://proxy:1080"},
+		{"HTTPS_PROXY over ALL_PROXY", "wss://chat.example.com", map[string]string{"HTTPS_PROXY": "http://proxy:3128", "ALL_PROXY": "socks5://proxy:1080"}, "http://proxy:3128"},
+		{"NO_PROXY host", "wss://chat.example.com", map[string]string{"ALL_PROXY": "socks5://proxy:1080", "NO_PROXY": "localhost,chat.example.com"}, ""},
+		{"NO_PROXY domain", "wss://chat.example.com", map[string]string{"ALL_PROXY": "socks5://proxy:1080", "NO_PROXY": ".example.com"}, ""},
+		{"NO_PROXY with port", "ws://10.0.0.1:8080", map[string]string{"HTTP_PROXY": "http://proxy:3128", "no_proxy": "10.0.0.1:8080"}, ""},
+		{"NO_PROXY star", "wss://chat.example.com", map[string]string{"ALL_PROXY": "socks5://proxy:1080", "NO_PROXY": "*"}, ""},
+		{"NO_PROXY other domain", "wss://chat.example.com", map[string]string{"ALL_PROXY": "socks5://proxy:1080", "NO_PROXY": "example.org,notexample.com"}, "socks5://proxy:1080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			proxy, err := proxyFromEnvironment(*u, func(name string) string { return tt.env[name] })
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if proxy != nil {
+				got = proxy.String()
+			}
+			if got != tt.want {
+				t.Errorf("proxy = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseProxyRejectsUnknownScheme(t *testing.T) {
+	if _, err := parseProxy("ftp://proxy:21"); err == nil {
+		t.Error("parseProxy accepted an ftp:// proxy")
+	}
+}
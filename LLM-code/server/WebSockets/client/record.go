@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// A session recording (-record file) is a JSON line per frame, each with
+// the wall-clock time it was sent or received:
+//
+//	{"time":"...","dir":"connect","payload":"ws://127.0.0.1:8080/ws"}
+//	{"time":"...","dir":"send","opcode":1,"payload":"alice"}
+//	{"time":"...","dir":"recv","opcode":1,"payload":"{\"type\":\"join\",...}"}
+//
+// A "connect" entry starts every connection, so reconnects are kept apart.
+// "client replay" plays recordings back against a server; see runReplay.
+
+// recordEntry is one line of a recording.
+type recordEntry struct {
+	Time    time.Time `json:"time"`
+	Dir     string    `json:"dir"` // "connect", "send" or "recv"
+	Opcode  byte      `json:"opcode,omitempty"`
+	Payload string    `json:"payload,omitempty"`
+}
+
+// recorder appends frames to a recording. A nil recorder records nothing.
+type recorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// openRecorder creates the recording file at path, or returns nil if path
+// is empty. Recordings hold message contents, so only the user can read
+// them.
+func openRecorder(path string) (*recorder, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (r *recorder) record(dir string, opcode byte, payload []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enc.Encode(recordEntry{Time: time.Now(), Dir: dir, Opcode: opcode, Payload: string(payload)})
+}
+
+func (r *recorder) close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// replayWait is how long replay keeps listening after a connection's last
+// recorded frame, by default.
+const replayWait = 2 * time.Second
+
+// runReplay implements "client replay [flags] recording...". It replays the
+// frames each recording sent, one connection per recorded connection, at
+// the recorded times (divided by -speed), with all recordings sharing one
+// clock so several clients recorded together interact as they did. It then
+// compares what each connection received with the recording and returns
+// exitMismatch if anything differs.
+//
+// Message IDs and timestamps are chosen by the server, so they are ignored
+// when comparing, and IDs in replayed edits, deletes, reactions and read
+// markers are translated to the IDs the server hands out this time.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	addr := fs.String("addr", "", "server address as host:port (default: the recorded one)")
+	useTLS := fs.Bool("tls", false, "connect over TLS (wss://)")
+	speed := fs.Float64("speed", 1, "playback speed; 10 replays ten times faster, 0 without any delays")
+	wait := fs.Duration("wait", replayWait, "how long to keep listening after a connection's last recorded frame")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [flags] recording...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 || *speed < 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	replays := make([]*replay, fs.NArg())
+	var start time.Time
+	for i, path := range fs.Args() {
+		r, err := loadReplay(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+		if start.IsZero() || r.conns[0].at.Before(start) {
+			start = r.conns[0].at
+		}
+		replays[i] = r
+	}
+
+	c := &replayClock{recorded: start, started: time.Now(), speed: *speed}
+	var wg sync.WaitGroup
+	for _, r := range replays {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.run(c, *addr, *useTLS, *wait)
+		}()
+	}
+	wg.Wait()
+
+	code := exitOK
+	for _, r := range replays {
+		if r.report(os.Stdout) {
+			continue
+		}
+		if r.err != nil {
+			code = exitConnect
+		} else if code == exitOK {
+			code = exitMismatch
+		}
+	}
+	return code
+}
+
+// replayClock maps recorded times to playback times.
+type replayClock struct {
+	recorded time.Time // earliest time in any recording
+	started  time.Time
+	speed    float64
+}
+
+// sleepUntil waits until the playback time of recorded time t.
+func (c *replayClock) sleepUntil(t time.Time) {
+	if c.speed == 0 {
+		return
+	}
+	offset := time.Duration(float64(t.Sub(c.recorded)) / c.speed)
+	time.Sleep(time.Until(c.started.Add(offset)))
+}
+
+// replay is one recording being played back.
+type replay struct {
+	path  string
+	conns []*replayConn
+	err   error // the connection error that ended playback early
+
+	// ids are the message IDs received in the recording, in order of
+	// first appearance; idMap maps them to the IDs received on replay, and
+	// replayed holds the latter.
+	ids      []string
+	idMap    map[string]string
+	replayed map[string]bool
+}
+
+// replayConn is one recorded connection.
+type replayConn struct {
+	url  string
+	at   time.Time     // when it was opened
+	sent []recordEntry // frames the client sent
+	want []recordEntry // frames the client received
+	got  []recordEntry // frames received on replay
+}
+
+func loadReplay(path string) (*replay, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := &replay{path: path, idMap: make(map[string]string), replayed: make(map[string]bool)}
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<24)
+	for line := 1; scanner.Scan(); line++ {
+		var e recordEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if e.Dir == "connect" {
+			r.conns = append(r.conns, &replayConn{url: e.Payload, at: e.Time})
+			continue
+		}
+		if len(r.conns) == 0 {
+			return nil, fmt.Errorf("%s:%d: frame before the first connect", path, line)
+		}
+		conn := r.conns[len(r.conns)-1]
+		switch e.Dir {
+		case "send":
+			conn.sent = append(conn.sent, e)
+		case "recv":
+			conn.want = append(conn.want, e)
+			if ev, ok := decodeEvent([]byte(e.Payload)); ok && ev.ID != "" && !seen[ev.ID] {
+				seen[ev.ID] = true
+				r.ids = append(r.ids, ev.ID)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown direction %q", path, line, e.Dir)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(r.conns) == 0 {
+		return nil, fmt.Errorf("%s: no connections recorded", path)
+	}
+	return r, nil
+}
+
+// run plays the recorded connections back one after another.
+func (r *replay) run(c *replayClock, addr string, useTLS bool, wait time.Duration) {
+	for i, rc := range r.conns {
+		u, err := url.Parse(rc.url)
+		if err != nil {
+			r.err = err
+			return
+		}
+		if addr != "" {
+			u.Host = addr
+		}
+		if useTLS {
+			u.Scheme = "wss"
+		}
+		// Listen until the next connection starts or, for the last one,
+		// for wait after its last frame.
+		end := rc.at
+		if n := len(rc.sent); n > 0 && rc.sent[n-1].Time.After(end) {
+			end = rc.sent[n-1].Time
+		}
+		if n := len(rc.want); n > 0 && rc.want[n-1].Time.After(end) {
+			end = rc.want[n-1].Time
+		}
+		if i+1 < len(r.conns) {
+			end = r.conns[i+1].at
+		}
+
+		c.sleepUntil(rc.at)
+		if r.err = r.play(rc, *u, c, end, wait); r.err != nil {
+			return
+		}
+	}
+}
+
+// play replays one connection and collects what it receives.
+func (r *replay) play(rc *replayConn, u url.URL, c *replayClock, end time.Time, wait time.Duration) error {
+	proxy, err := proxyFromEnvironment(u, os.Getenv)
+	if err != nil {
+		return err
+	}
+	conn, err := dialWebSocket(u, proxy)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var mu sync.Mutex
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			opcode, payload, err := readWebSocketFrame(conn)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			rc.got = append(rc.got, recordEntry{Time: time.Now(), Dir: "recv", Opcode: opcode, Payload: string(payload)})
+			r.learnID(payload)
+			mu.Unlock()
+			if opcode == 0x8 {
+				return
+			}
+		}
+	}()
+
+	for _, e := range rc.sent {
+		c.sleepUntil(e.Time)
+		mu.Lock()
+		payload := r.translateIDs([]byte(e.Payload))
+		mu.Unlock()
+		if err := writeWebSocketFrame(conn, e.Opcode, payload); err != nil {
+			return err
+		}
+	}
+
+	c.sleepUntil(end)
+	select {
+	case <-done:
+	case <-time.After(wait):
+	}
+	conn.Close()
+	<-done
+	return nil
+}
+
+// learnID maps the next recorded message ID to a newly seen replayed one.
+func (r *replay) learnID(payload []byte) {
+	ev, ok := decodeEvent(payload)
+	if !ok || ev.ID == "" || r.replayed[ev.ID] {
+		return
+	}
+	r.replayed[ev.ID] = true
+	if n := len(r.idMap); n < len(r.ids) {
+		r.idMap[r.ids[n]] = ev.ID
+	}
+}
+
+// translateIDs replaces a recorded message ID in an outgoing event with
+// the one the server used on replay.
+func (r *replay) translateIDs(payload []byte) []byte {
+	ev, ok := decodeEvent(payload)
+	if !ok || ev.ID == "" {
+		return payload
+	}
+	if id, ok := r.idMap[ev.ID]; ok {
+		ev.ID = id
+		return encodeEvent(ev)
+	}
+	return payload
+}
+
+// report prints how the replay went and reports whether it matched.
+func (r *replay) report(w io.Writer) bool {
+	var sent, received int
+	var missing, unexpected []string
+	var reordered string // the first frame received out of order
+	for _, rc := range r.conns {
+		sent += len(rc.sent)
+		received += len(rc.got)
+		want, got := normalizeFrames(rc.want), normalizeFrames(rc.got)
+		if i := firstDifference(want, got); i >= 0 && reordered == "" {
+			reordered = fmt.Sprintf("recorded %s, replayed %s", want[i], got[i])
+		}
+		m, u := frameDiff(want, got)
+		missing = append(missing, m...)
+		unexpected = append(unexpected, u...)
+	}
+	fmt.Fprintf(w, "%s: %d connections, %d frames sent, %d received: ", r.path, len(r.conns), sent, received)
+	switch {
+	case r.err != nil:
+		fmt.Fprintf(w, "replay failed: %v\n", r.err)
+		return false
+	case reordered == "" && len(missing) == 0 && len(unexpected) == 0:
+		fmt.Fprintln(w, "matches the recording")
+		return true
+	case len(missing) == 0 && len(unexpected) == 0:
+		fmt.Fprintf(w, "same frames as the recording, in a different order\n  first difference: %s\n", reordered)
+		return false
+	}
+	fmt.Fprintf(w, "%d missing, %d unexpected\n", len(missing), len(unexpected))
+	const maxShown = 10
+	for _, f := range missing[:min(len(missing), maxShown)] {
+		fmt.Fprintf(w, "  missing:    %s\n", f)
+	}
+	for _, f := range unexpected[:min(len(unexpected), maxShown)] {
+		fmt.Fprintf(w, "  unexpected: %s\n", f)
+	}
+	return false
+}
+
+// normalizeFrames renders received frames for comparison: times are
+// dropped and message IDs replaced by their order of first appearance.
+// Close frames are left out, since whether the client read the server's
+// close before exiting is down to timing, and so are keepalive pings and
+// pongs, which depend on how long the session lasted.
+func normalizeFrames(frames []recordEntry) []string {
+	labels := make(map[string]string)
+	var out []string
+	for _, f := range frames {
+		if f.Opcode == 0x8 || f.Opcode == 0x9 || f.Opcode == 0xA {
+			continue
+		}
+		if f.Opcode != 0x1 {
+			out = append(out, fmt.Sprintf("opcode %d %q", f.Opcode, f.Payload))
+			continue
+		}
+		ev, ok := decodeEvent([]byte(f.Payload))
+		if !ok {
+			out = append(out, f.Payload)
+			continue
+		}
+		if ev.ID != "" {
+			if _, ok := labels[ev.ID]; !ok {
+				labels[ev.ID] = fmt.Sprintf("#%d", len(labels)+1)
+			}
+			ev.ID = labels[ev.ID]
+		}
+		ev.Time = time.Time{}
+		out = append(out, string(encodeEvent(ev)))
+	}
+	return out
+}
+
+// firstDifference returns the first index at which want and got differ, or
+// -1 if one is a prefix of the other.
+func firstDifference(want, got []string) int {
+	for i := range min(len(want), len(got)) {
+		if want[i] != got[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+// frameDiff returns the frames in want but not got and those in got but
+// not want, counting duplicates.
+func frameDiff(want, got []string) (missing, unexpected []string) {
+	counts := make(map[string]int)
+	for _, f := range got {
+		counts[f]++
+	}
+	for _, f := range want {
+		if counts[f] > 0 {
+			counts[f]--
+		} else {
+			missing = append(missing, f)
+		}
+	}
+	for _, f := range got {
+		if counts[f] > 0 {
+			counts[f]--
+			unexpected = append(unexpected, f)
+		}
+	}
+	return missing, unexpected
+}
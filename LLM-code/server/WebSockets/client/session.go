@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// typingInterval is how often at most the client tells the server that the
+// user is typing. The server applies the same limit.
+const typingInterval = 2 * time.Second
+
+// receiptInterval is how often pending read markers are flushed to the
+// server, so a burst of messages produces one receipt instead of many.
+const receiptInterval = time.Second
+
+// session is the client's side of the conversation. It outlives any one
+// connection: it serialises writes from the input loop and background
+// tickers, tracks the current and joined rooms, and reconnects when the
+// connection drops (see connection.go).
+type session struct {
+	url      url.URL
+	proxy    *url.URL // nil to connect directly
+	username string   // trimmed, as the server trims it; sent first on every connection
+	t        *transcript
+	self     string // our username as the server reports it
+	identity *ecdh.PrivateKey
+	keys     *keyring
+
+	// wmu serialises frame writes and guards conn (nil while offline),
+	// outbox, the events typed while offline, and the keepalive state of
+	// the connection: readDone, closed when its readLoop returns, and
+	// unanswered, the pings sent since the server was last heard from.
+	wmu        sync.Mutex
+	conn       net.Conn
+	outbox     []event
+	readDone   chan struct{}
+	unanswered int
+
+	mu         sync.Mutex
+	room       string
+	rooms      map[string]bool // rooms the server confirmed we joined
+	closing    bool
+	lastTyping time.Time
+
+	// peerKeys holds public keys fetched from the server this session that
+	// match the keyring; offered holds changed keys awaiting /trust; and
+	// pending holds private messages waiting for the recipient's key.
+	peerKeys map[string][]byte
+	offered  map[string][]byte
+	pending  map[string][]string
+
+	// observe, if set before connecting, is called with every event
+	// received, after private messages have been decrypted.
+	observe func(event)
+	// rec, if set before connecting, records every frame (see record.go).
+	rec *recorder
+	// history, if set before connecting, keeps the room messages received
+	// (see history.go).
+	history *history
+}
+
+func newSession(u url.URL, username string, t *transcript, identity *ecdh.PrivateKey, keys *keyring) *session {
+	s := &session{
+		url:      u,
+		username: username,
+		t:        t,
+		self:     html.EscapeString(username),
+		identity: identity,
+		keys:     keys,
+		rooms:    map[string]bool{defaultRoom: true},
+		peerKeys: make(map[string][]byte),
+		offered:  make(map[string][]byte),
+		pending:  make(map[string][]string),
+	}
+	s.setRoom(defaultRoom)
+	return s
+}
+
+// send writes an event as a text frame, failing with errOffline while
+// reconnecting. Input typed by the user goes through queue instead.
+func (s *session) send(ev event) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.conn == nil {
+		return errOffline
+	}
+	return s.writeFrame(s.conn, 0x1, encodeEvent(ev))
+}
+
+// writeFrame writes a frame to conn, recording it if enabled. Callers must
+// hold s.wmu.
+func (s *session) writeFrame(conn net.Conn, opcode byte, payload []byte) error {
+	s.rec.record("send", opcode, payload)
+	return writeWebSocketFrame(conn, opcode, payload)
+}
+
+// close stops reconnecting and, if connected, performs the closing
+// handshake: it sends a close frame and waits up to closeTimeout for the
+// server's reply before hanging up. Only the first call has any effect.
+func (s *session) close() error {
+	s.mu.Lock()
+	already := s.closing
+	s.closing = true
+	s.mu.Unlock()
+	if already {
+		return nil
+	}
+	s.wmu.Lock()
+	conn, done := s.conn, s.readDone
+	var err error
+	if conn != nil {
+		err = s.writeFrame(conn, 0x8, binary.BigEndian.AppendUint16(nil, closeNormal))
+	}
+	s.wmu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	if err == nil {
+		select {
+		case <-done:
+		case <-time.After(closeTimeout):
+			err = errors.New("the server did not answer the close frame")
+		}
+	}
+	conn.Close()
+	return err
+}
+
+func (s *session) currentRoom() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.room
+}
+
+func (s *session) setRoom(room string) {
+	s.mu.Lock()
+	s.room = room
+	s.mu.Unlock()
+	s.t.setRoom(room)
+}
+
+// noteTyping tells the server the user is typing in the current room, at
+// most once per typingInterval.
+func (s *session) noteTyping() {
+	s.mu.Lock()
+	now := time.Now()
+	if now.Sub(s.lastTyping) < typingInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastTyping = now
+	room := s.room
+	s.mu.Unlock()
+	s.send(event{Type: eventTyping, Room: room})
+}
+
+// sendReceipts periodically flushes read markers for messages the
+// transcript has shown, until stop is closed.
+func (s *session) sendReceipts(stop <-chan struct{}) {
+	ticker := time.NewTicker(receiptInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			s.t.tick(now)
+			for room, id := range s.t.takeUnread() {
+				// Receipts are best effort; while offline they are dropped.
+				s.send(event{Type: eventRead, Room: room, ID: id})
+			}
+		}
+	}
+}
+
+// handleInput acts on a line typed by the user. It returns false once the
+// user quits.
+func (s *session) handleInput(line string) bool {
+	if strings.ToLower(line) == "quit" {
+		s.close()
+		return false
+	}
+	ev, err := s.parseInput(line)
+	if err != nil {
+		s.t.println("! " + err.Error())
+		return true
+	}
+	if ev.Type == "" {
+		return true
+	}
+	if err := s.queue(ev); err != nil {
+		s.t.println("! " + err.Error())
+	}
+	return true
+}
+
+// parseInput turns a line typed by the user into an event for the server.
+// Lines starting with "/" are commands; anything else is a chat message
+// for the current room. Commands handled locally return an event with an
+// empty Type, meaning there is nothing to send.
+func (s *session) parseInput(line string) (event, error) {
+	room := s.currentRoom()
+	if !strings.HasPrefix(line, "/") {
+		return event{Type: eventMessage, Room: room, Text: line}, nil
+	}
+	cmd, rest, _ := strings.Cut(line, " ")
+	arg1, arg2, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	arg2 = strings.TrimSpace(arg2)
+
+	switch cmd {
+	case "/join":
+		if arg1 == "" {
+			return event{}, errors.New("usage: /join <room>")
+		}
+		s.setRoom(arg1)
+		return event{Type: eventJoin, Room: arg1}, nil
+	case "/msg":
+		if arg2 == "" {
+			return event{}, errors.New("usage: /msg <user> <text>")
+		}
+		return s.privateMessage(arg1, arg2)
+	case "/trust":
+		return event{}, s.trust(arg1)
+	case "/fingerprint":
+		return event{}, s.showFingerprint(arg1)
+	case "/history":
+		return event{}, s.showHistory(arg1)
+	case "/search":
+		return event{}, s.searchHistory(strings.TrimSpace(rest))
+	case "/export":
+		return event{}, s.exportHistory(arg1, arg2)
+	case "/ping":
+		if rtt := s.t.lastLatency(); rtt > 0 {
+			s.t.println(fmt.Sprintf("* round-trip time to %s: %s", s.url.Host, rtt.Round(time.Millisecond/10)))
+		} else {
+			s.t.println("* no round-trip time measured yet")
+		}
+		return event{}, nil
+	case "/leave":
+		if arg1 == "" {
+			arg1 = room
+		}
+		if arg1 == room {
+			s.setRoom(defaultRoom)
+		}
+		return event{Type: eventLeave, Room: arg1}, nil
+	}
+
+	var ev event
+	switch cmd {
+	case "/edit":
+		if arg2 == "" {
+			return ev, errors.New("usage: /edit <id> <text>")
+		}
+		ev = event{Type: eventEdit, Text: arg2}
+	case "/delete":
+		ev = event{Type: eventDelete}
+	case "/react":
+		if arg2 == "" {
+			return ev, errors.New("usage: /react <id> <emoji>")
+		}
+		ev = event{Type: eventReact, Emoji: arg2}
+	default:
+		return ev, fmt.Errorf("unknown command %s", cmd)
+	}
+	id, err := s.t.resolve(arg1)
+	if err != nil {
+		return event{}, err
+	}
+	ev.ID = id
+	return ev, nil
+}
+
+// typingReader calls onInput whenever input arrives from r. A line-buffered
+// terminal delivers input once per line, right before it is sent, so there
+// the notice is immediately superseded by the message itself.
+type typingReader struct {
+	r       io.Reader
+	onInput func()
+}
+
+func (tr typingReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		tr.onInput()
+	}
+	return n, err
+}
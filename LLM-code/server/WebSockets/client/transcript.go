@@ -0,0 +1,401 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// shortIDLen is how many characters of a message ID are shown on screen.
+// Commands accept any unique prefix of at least this length or shorter.
+const shortIDLen = 6
+
+// typingNoticeDelay is how long someone must have been typing before the
+// transcript mentions it. Typing notices that are followed by a message
+// within this window are never shown.
+const typingNoticeDelay = time.Second
+
+// typingExpiry is how long a typing notice stays valid without a refresh.
+const typingExpiry = 5 * time.Second
+
+// transcript turns chat events into lines on a display and remembers which
+// line shows each message, so that edits, deletes and reaction updates can
+// be redrawn. It also keeps the status bar (connection, room, who is
+// typing) up to date on displays that have one.
+type transcript struct {
+	mu       sync.Mutex
+	out      display
+	self     string        // our username as the server reports it
+	room     string        // current room; messages from other rooms are prefixed
+	conn     string        // connection state shown in the status bar
+	latency  time.Duration // last round-trip time to the server, if known
+	color    bool          // whether usernames are colored
+	messages map[string]*shownMessage
+	order    []string // message IDs in arrival order
+
+	// readers maps room -> username -> message ID their read marker is on.
+	readers map[string]map[string]string
+	// unread maps room -> newest message we have shown but not reported.
+	unread map[string]string
+	// typing maps "room\x00user" -> when they started and last typed.
+	typing map[string]*typingState
+}
+
+type typingState struct {
+	room, user      string
+	since, lastSeen time.Time
+	announced       bool
+}
+
+type shownMessage struct {
+	event
+	line      *line
+	deleted   bool
+	reactions map[string]int
+	seenBy    []string // users whose read marker is on this message
+}
+
+func newTranscript(out display, self string) *transcript {
+	return &transcript{
+		out:      out,
+		self:     self,
+		room:     defaultRoom,
+		color:    out.statusBar(),
+		messages: make(map[string]*shownMessage),
+		readers:  make(map[string]map[string]string),
+		unread:   make(map[string]string),
+		typing:   make(map[string]*typingState),
+	}
+}
+
+// setRoom changes the current room.
+func (t *transcript) setRoom(room string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.room = room
+	t.updateStatus()
+}
+
+// setConnState describes the connection in the status bar, e.g.
+// "connected to 127.0.0.1:8080" or "reconnecting".
+func (t *transcript) setConnState(state string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conn = state
+	t.latency = 0
+	t.updateStatus()
+}
+
+// setLatency shows the round-trip time of the latest ping in the status
+// bar.
+func (t *transcript) setLatency(rtt time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.latency = rtt
+	t.updateStatus()
+}
+
+// lastLatency returns the round-trip time of the latest ping, or 0 if none
+// was answered on the current connection.
+func (t *transcript) lastLatency() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.latency
+}
+
+// inputLine records that the terminal echoed a line of user input.
+func (t *transcript) inputLine() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.out.inputLine()
+}
+
+// println prints a line that isn't tied to any message. Lines may quote
+// text from the server or the history files, so they are sanitized.
+func (t *transcript) println(s string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.out.add(sanitize(s))
+}
+
+// render prints or applies an event received from the server.
+func (t *transcript) render(ev event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ev.ID, ev.Room = sanitize(ev.ID), sanitize(ev.Room)
+	ev.From, ev.To, ev.Text = sanitize(ev.From), sanitize(ev.To), sanitize(ev.Text)
+	if ev.Reactions != nil {
+		reactions := make(map[string]int, len(ev.Reactions))
+		for emoji, n := range ev.Reactions {
+			reactions[sanitize(emoji)] += n
+		}
+		ev.Reactions = reactions
+	}
+
+	switch ev.Type {
+	case eventMessage, eventPrivate:
+		m := &shownMessage{event: ev}
+		t.messages[ev.ID] = m
+		t.order = append(t.order, ev.ID)
+		m.line = t.out.add(t.format(m))
+		t.stopTyping(ev.Room, ev.From)
+		// Only live room messages get read receipts; stored mentions may be
+		// from rooms we haven't joined.
+		if ev.Type == eventMessage && !ev.Offline && ev.From != t.self {
+			t.unread[ev.Room] = ev.ID
+		}
+	case eventEdit:
+		if m, ok := t.messages[ev.ID]; ok {
+			m.Text, m.Edited = ev.Text, true
+			t.update(m, "edited")
+		}
+	case eventDelete:
+		if m, ok := t.messages[ev.ID]; ok {
+			m.deleted = true
+			t.update(m, "deleted")
+		}
+	case eventReactions:
+		if m, ok := t.messages[ev.ID]; ok {
+			m.reactions = ev.Reactions
+			t.update(m, "reactions")
+		}
+	case eventJoin:
+		if ev.From != t.self {
+			t.out.add(fmt.Sprintf("* %s joined #%s", t.name(ev.From), ev.Room))
+		}
+	case eventLeave:
+		t.stopTyping(ev.Room, ev.From)
+		t.out.add(fmt.Sprintf("* %s left #%s", t.name(ev.From), ev.Room))
+	case eventTyping:
+		key := ev.Room + "\x00" + ev.From
+		now := time.Now()
+		if st, ok := t.typing[key]; ok {
+			st.lastSeen = now
+		} else {
+			t.typing[key] = &typingState{room: ev.Room, user: ev.From, since: now, lastSeen: now}
+			t.updateStatus()
+		}
+	case eventRead:
+		t.moveReadMarker(ev.Room, ev.From, ev.ID)
+	case eventNotice:
+		t.out.add("* " + ev.Text)
+	case eventError:
+		t.out.add("! " + ev.Text)
+	default:
+		t.out.add(ev.Text)
+	}
+}
+
+// tick forgets typing notices that have expired. Displays without a status
+// bar get a line for users who have been typing for a while instead.
+func (t *transcript) tick(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	changed := false
+	for key, st := range t.typing {
+		switch {
+		case now.Sub(st.lastSeen) > typingExpiry:
+			delete(t.typing, key)
+			changed = true
+		case !st.announced && !t.out.statusBar() && now.Sub(st.since) >= typingNoticeDelay:
+			st.announced = true
+			t.out.add(fmt.Sprintf("* %s is typing in #%s...", st.user, st.room))
+		}
+	}
+	if changed {
+		t.updateStatus()
+	}
+}
+
+// stopTyping forgets that user is typing in room. Callers must hold t.mu.
+func (t *transcript) stopTyping(room, user string) {
+	key := room + "\x00" + user
+	if _, ok := t.typing[key]; ok {
+		delete(t.typing, key)
+		t.updateStatus()
+	}
+}
+
+// updateStatus refreshes the status bar. Callers must hold t.mu.
+func (t *transcript) updateStatus() {
+	if !t.out.statusBar() {
+		return
+	}
+	var typing []string
+	for _, st := range t.typing {
+		if st.room == t.room {
+			typing = append(typing, st.user)
+		}
+	}
+	sort.Strings(typing)
+	status := " " + t.conn
+	if t.latency > 0 {
+		status += fmt.Sprintf(" (%s)", t.latency.Round(time.Millisecond/10))
+	}
+	status += fmt.Sprintf(" │ #%s │ %s", t.room, t.self)
+	switch len(typing) {
+	case 0:
+	case 1:
+		status += " │ " + typing[0] + " is typing..."
+	default:
+		status += " │ " + strings.Join(typing, ", ") + " are typing..."
+	}
+	t.out.status(status)
+}
+
+// takeUnread returns, per room, the newest message shown since the last
+// call, for the session to send as read markers.
+func (t *transcript) takeUnread() map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	unread := t.unread
+	t.unread = make(map[string]string)
+	return unread
+}
+
+// moveReadMarker moves user's "seen" mark in room to message id, redrawing
+// both the old and the new message. Callers must hold t.mu.
+func (t *transcript) moveReadMarker(room, user, id string) {
+	if user == t.self {
+		return
+	}
+	markers := t.readers[room]
+	if markers == nil {
+		markers = make(map[string]string)
+		t.readers[room] = markers
+	}
+	if old, ok := t.messages[markers[user]]; ok {
+		old.seenBy = slices.DeleteFunc(old.seenBy, func(u string) bool { return u == user })
+		t.update(old, "seen by")
+	}
+	markers[user] = id
+	if m, ok := t.messages[id]; ok {
+		m.seenBy = append(m.seenBy, user)
+		sort.Strings(m.seenBy)
+		t.update(m, "seen by")
+	}
+}
+
+// update redraws a message after it changed. Callers must hold t.mu.
+func (t *transcript) update(m *shownMessage, what string) {
+	m.line.text = t.format(m)
+	t.out.redraw(m.line, what)
+}
+
+// resolve expands a message ID prefix typed by the user into a full ID.
+func (t *transcript) resolve(prefix string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if prefix == "" {
+		return "", errors.New("missing message ID")
+	}
+	var found string
+	for _, id := range t.order {
+		if strings.HasPrefix(id, prefix) {
+			if found != "" {
+				return "", fmt.Errorf("message ID %q is ambiguous", prefix)
+			}
+			found = id
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("no message with ID %q", prefix)
+	}
+	return found, nil
+}
+
+func (m *shownMessage) shortID() string {
+	if len(m.ID) > shortIDLen {
+		return m.ID[:shortIDLen]
+	}
+	return m.ID
+}
+
+// format renders a message as a single line, e.g.
+// "[a1b2c3] alice: hello (edited)  👍 2  ✓ bob". Messages from rooms other
+// than the current one are prefixed with the room name, private messages
+// show "sender -> recipient", and messages kept while we were offline show
+// when they were sent. Callers must hold t.mu.
+func (t *transcript) format(m *shownMessage) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] ", m.shortID())
+	if m.Offline {
+		fmt.Fprintf(&b, "(%s) ", m.Time.Local().Format("Jan 2 15:04"))
+	}
+	if m.Room != "" && m.Room != t.room {
+		fmt.Fprintf(&b, "#%s ", m.Room)
+	}
+	if m.deleted {
+		b.WriteString("(message deleted)")
+		return b.String()
+	}
+	if m.Type == eventPrivate {
+		fmt.Fprintf(&b, "%s -> %s: %s", t.name(m.From), t.name(m.To), m.Text)
+	} else {
+		fmt.Fprintf(&b, "%s: %s", t.name(m.From), m.Text)
+	}
+	if m.Edited {
+		b.WriteString(" (edited)")
+	}
+	if len(m.reactions) > 0 {
+		emojis := make([]string, 0, len(m.reactions))
+		for e := range m.reactions {
+			emojis = append(emojis, e)
+		}
+		sort.Strings(emojis)
+		b.WriteString(" ")
+		for _, e := range emojis {
+			fmt.Fprintf(&b, " %s %d", e, m.reactions[e])
+		}
+	}
+	if len(m.seenBy) > 0 {
+		b.WriteString("  ✓ " + strings.Join(m.seenBy, ", "))
+	}
+	return b.String()
+}
+
+// sanitize replaces the control characters in text from other users with
+// '?', so they can't recolor the terminal, move the cursor or clear the
+// screen. Tabs are kept. Invalid UTF-8, which some terminals read as 8-bit
+// control codes, becomes U+FFFD.
+func sanitize(s string) string {
+	if utf8.ValidString(s) && !strings.ContainsFunc(s, isControl) {
+		return s
+	}
+	return strings.Map(func(r rune) rune {
+		if isControl(r) {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+func isControl(r rune) bool {
+	return r != '\t' && unicode.IsControl(r)
+}
+
+// nameColors are the ANSI foreground colors usernames are drawn in.
+var nameColors = []int{31, 32, 33, 34, 35, 36, 91, 92, 93, 94, 95, 96}
+
+// name returns user as it should be shown: in a color picked from the name,
+// so everyone keeps the same color, and bold for ourselves.
+func (t *transcript) name(user string) string {
+	if !t.color {
+		return user
+	}
+	h := fnv.New32a()
+	h.Write([]byte(user))
+	color := nameColors[h.Sum32()%uint32(len(nameColors))]
+	if user == t.self {
+		return fmt.Sprintf("\x1b[1;%dm%s\x1b[0m", color, user)
+	}
+	return fmt.Sprintf("\x1b[%dm%s\x1b[0m", color, user)
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxScrollback bounds how many lines the message pane keeps.
+const maxScrollback = 5000
+
+// inputPrompt is shown in front of the input line.
+const inputPrompt = "> "
+
+// sigwinch is sent when the terminal is resized. It is 28 on Linux and the
+// BSDs (including macOS); syscall only names it on some of them.
+const sigwinch = syscall.Signal(0x1c)
+
+// tui is a full-screen terminal interface: a scrollable message pane, a
+// status bar and an input line at the bottom with editing and history.
+// Incoming messages are drawn in the pane, so they never interfere with
+// what the user is typing.
+//
+// Keys: Enter sends, Left/Right/Home/End (or Ctrl-B/F/A/E) move, Backspace
+// and Delete erase, Ctrl-U/K clear before/after the cursor, Ctrl-W erases a
+// word, Up/Down (or Ctrl-P/N) walk the input history, PgUp/PgDn scroll the
+// pane, Ctrl-L redraws, and Ctrl-C or Ctrl-D on an empty line quit.
+type tui struct {
+	mu            sync.Mutex
+	out           *os.File
+	width, height int
+	restore       func() // nil once closed
+
+	lines  []*line
+	scroll int // rows the pane is scrolled up from the bottom
+	state  string
+
+	input   []rune
+	cursor  int
+	history []string
+	histPos int    // index into history while browsing; len(history) otherwise
+	draft   []rune // the unsent line, kept while browsing history
+}
+
+// newTUI switches the terminal to raw mode and the alternate screen.
+func newTUI() (*tui, error) {
+	width, height, err := terminalSize()
+	if err != nil {
+		return nil, err
+	}
+	if height < 3 {
+		return nil, errors.New("terminal is too small")
+	}
+	restore, err := enterRawMode()
+	if err != nil {
+		return nil, err
+	}
+	ui := &tui{out: os.Stdout, width: width, height: height, restore: restore}
+	fmt.Fprint(ui.out, "\x1b[?1049h")
+	ui.mu.Lock()
+	ui.draw()
+	ui.mu.Unlock()
+	return ui, nil
+}
+
+// close leaves the alternate screen and restores the terminal settings.
+func (ui *tui) close() {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	if ui.restore == nil {
+		return
+	}
+	fmt.Fprint(ui.out, "\x1b[?1049l")
+	ui.restore()
+	ui.restore = nil
+}
+
+func (ui *tui) add(text string) *line {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	l := &line{text: text}
+	ui.lines = append(ui.lines, l)
+	if over := len(ui.lines) - maxScrollback; over > 0 {
+		ui.lines = slices.Delete(ui.lines, 0, over)
+	}
+	if ui.scroll > 0 {
+		// Keep what the user scrolled to in view.
+		ui.scroll += len(wrap(text, ui.width))
+	}
+	ui.draw()
+	return l
+}
+
+func (ui *tui) redraw(*line, string) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	ui.draw()
+}
+
+// inputLine does nothing: typed lines are not echoed into the pane.
+func (ui *tui) inputLine() {}
+
+func (ui *tui) statusBar() bool { return true }
+
+func (ui *tui) status(text string) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	ui.state = text
+	ui.draw()
+}
+
+// run reads keys until the user quits or stdin fails. Every submitted line
+// is passed to onLine, which returns false to quit; onEdit is called when
+// the user changes a line that isn't a command.
+func (ui *tui) run(onLine func(string) bool, onEdit func()) {
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, sigwinch)
+	defer signal.Stop(resized)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-resized:
+				ui.resize()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 256)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, k := range parseKeys(buf[:n]) {
+			ui.mu.Lock()
+			result, text := ui.press(k)
+			ui.draw()
+			ui.mu.Unlock()
+
+			switch result {
+			case keySubmit:
+				if !onLine(text) {
+					return
+				}
+			case keyEdited:
+				if text != "" && !strings.HasPrefix(text, "/") {
+					onEdit()
+				}
+			case keyQuit:
+				return
+			}
+		}
+	}
+}
+
+func (ui *tui) resize() {
+	width, height, err := terminalSize()
+	if err != nil || height < 3 {
+		return
+	}
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	ui.width, ui.height = width, height
+	ui.draw()
+}
+
+// key is a key press: a character, or the name of a special key.
+type key struct {
+	r    rune
+	name string
+}
+
+// controlKeys names the control characters the input line understands.
+var controlKeys = map[byte]string{
+	0x01: "home", 0x02: "left", 0x03: "interrupt", 0x04: "eof",
+	0x05: "end", 0x06: "right", 0x08: "backspace", 0x0a: "enter",
+	0x0b: "kill-end", 0x0c: "redraw", 0x0d: "enter", 0x0e: "down",
+	0x10: "up", 0x15: "kill", 0x17: "kill-word", 0x7f: "backspace",
+}
+
+// escapeKeys names the ANSI escape sequences (without "ESC [" or "ESC O")
+// sent by special keys.
+var escapeKeys = map[string]string{
+	"A": "up", "B": "down", "C": "right", "D": "left",
+	"H": "home", "F": "end", "1~": "home", "7~": "home",
+	"4~": "end", "8~": "end", "3~": "delete",
+	"5~": "page-up", "6~": "page-down",
+}
+
+// parseKeys splits raw terminal input into key presses. Unknown control
+// characters and escape sequences are dropped.
+func parseKeys(b []byte) []key {
+	var keys []key
+	for len(b) > 0 {
+		switch c := b[0]; {
+		case c == 0x1b:
+			if len(b) < 2 || (b[1] != '[' && b[1] != 'O') {
+				b = b[1:]
+				continue
+			}
+			// Parameters, then a final byte in 0x40-0x7e.
+			end := 2
+			for end < len(b) && (b[end] < 0x40 || b[end] > 0x7e) {
+				end++
+			}
+			end = min(end+1, len(b))
+			if name, ok := escapeKeys[string(b[2:end])]; ok {
+				keys = append(keys, key{name: name})
+			}
+			b = b[end:]
+		case c < 0x20 || c == 0x7f:
+			if name, ok := controlKeys[c]; ok {
+				keys = append(keys, key{name: name})
+			}
+			b = b[1:]
+		default:
+			r, size := utf8.DecodeRune(b)
+			keys = append(keys, key{r: r})
+			b = b[size:]
+		}
+	}
+	return keys
+}
+
+// keyResult tells run what a key press did.
+type keyResult int
+
+const (
+	keyNone   keyResult = iota
+	keyEdited           // the input line changed
+	keySubmit           // a line was entered
+	keyQuit             // the user asked to quit
+)
+
+// press applies k to the input line and returns what happened along with
+// the submitted or edited text. Callers must hold ui.mu.
+func (ui *tui) press(k key) (keyResult, string) {
+	if k.name == "" {
+		ui.input = slices.Insert(ui.input, ui.cursor, k.r)
+		ui.cursor++
+		return keyEdited, string(ui.input)
+	}
+
+	switch k.name {
+	case "enter":
+		text := string(ui.input)
+		if text == "" {
+			return keyNone, ""
+		}
+		if n := len(ui.history); n == 0 || ui.history[n-1] != text {
+			ui.history = append(ui.history, text)
+		}
+		ui.histPos = len(ui.history)
+		ui.input, ui.cursor, ui.draft = nil, 0, nil
+		ui.scroll = 0
+		return keySubmit, text
+	case "interrupt":
+		return keyQuit, ""
+	case "eof":
+		if len(ui.input) == 0 {
+			return keyQuit, ""
+		}
+		fallthrough
+	case "delete":
+		if ui.cursor < len(ui.input) {
+			ui.input = slices.Delete(ui.input, ui.cursor, ui.cursor+1)
+		}
+	case "backspace":
+		if ui.cursor > 0 {
+			ui.input = slices.Delete(ui.input, ui.cursor-1, ui.cursor)
+			ui.cursor--
+		}
+	case "kill":
+		ui.input = slices.Delete(ui.input, 0, ui.cursor)
+		ui.cursor = 0
+	case "kill-end":
+		ui.input = ui.input[:ui.cursor]
+	case "kill-word":
+		start := ui.cursor
+		for start > 0 && ui.input[start-1] == ' ' {
+			start--
+		}
+		for start > 0 && ui.input[start-1] != ' ' {
+			start--
+		}
+		ui.input = slices.Delete(ui.input, start, ui.cursor)
+		ui.cursor = start
+	case "left":
+		ui.cursor = max(ui.cursor-1, 0)
+		return keyNone, ""
+	case "right":
+		ui.cursor = min(ui.cursor+1, len(ui.input))
+		return keyNone, ""
+	case "home":
+		ui.cursor = 0
+		return keyNone, ""
+	case "end":
+		ui.cursor = len(ui.input)
+		return keyNone, ""
+	case "up":
+		if ui.histPos > 0 {
+			if ui.histPos == len(ui.history) {
+				ui.draft = ui.input
+			}
+			ui.histPos--
+			ui.input = []rune(ui.history[ui.histPos])
+			ui.cursor = len(ui.input)
+		}
+		return keyNone, ""
+	case "down":
+		if ui.histPos < len(ui.history) {
+			ui.histPos++
+			if ui.histPos == len(ui.history) {
+				ui.input = ui.draft
+			} else {
+				ui.input = []rune(ui.history[ui.histPos])
+			}
+			ui.cursor = len(ui.input)
+		}
+		return keyNone, ""
+	case "page-up":
+		ui.scroll += max(ui.height-3, 1)
+		return keyNone, ""
+	case "page-down":
+		ui.scroll = max(ui.scroll-max(ui.height-3, 1), 0)
+		return keyNone, ""
+	default: // "redraw"; draw happens after every key anyway
+		return keyNone, ""
+	}
+	return keyEdited, string(ui.input)
+}
+
+// draw repaints the whole screen. Callers must hold ui.mu.
+func (ui *tui) draw() {
+	if ui.restore == nil {
+		return
+	}
+	pane := ui.height - 2
+	rows := ui.paneRows(pane + ui.scroll)
+	ui.scroll = min(ui.scroll, max(len(rows)-pane, 0))
+	end := len(rows) - ui.scroll
+	visible := rows[max(end-pane, 0):end]
+
+	var b strings.Builder
+	b.WriteString("\x1b[?25l") // hide the cursor while drawing
+	for i := range pane {
+		fmt.Fprintf(&b, "\x1b[%d;1H\x1b[2K", i+1)
+		// Messages sit at the bottom of the pane, newest last.
+		if j := i - (pane - len(visible)); j >= 0 {
+			b.WriteString(visible[j] + "\x1b[0m")
+		}
+	}
+
+	state := ui.state
+	if ui.scroll > 0 {
+		state += " │ scrolled back (PgDn)"
+	}
+	state = truncate(state, ui.width)
+	state += strings.Repeat(" ", ui.width-utf8.RuneCountInString(state))
+	fmt.Fprintf(&b, "\x1b[%d;1H\x1b[2K\x1b[7m%s\x1b[0m", pane+1, state)
+
+	// Scroll the input line sideways to keep the cursor on screen.
+	avail := max(ui.width-len(inputPrompt)-1, 1)
+	offset := max(ui.cursor-avail, 0)
+	shown := ui.input[offset:min(len(ui.input), offset+avail)]
+	fmt.Fprintf(&b, "\x1b[%d;1H\x1b[2K%s%s", ui.height, inputPrompt, string(shown))
+	fmt.Fprintf(&b, "\x1b[%d;%dH\x1b[?25h", ui.height, len(inputPrompt)+ui.cursor-offset+1)
+	fmt.Fprint(ui.out, b.String())
+}
+
+// paneRows returns up to the last n screen rows of the message pane.
+// Callers must hold ui.mu.
+func (ui *tui) paneRows(n int) []string {
+	var rows []string
+	for i := len(ui.lines) - 1; i >= 0 && len(rows) < n; i-- {
+		wrapped := wrap(ui.lines[i].text, ui.width)
+		slices.Reverse(wrapped)
+		rows = append(rows, wrapped...)
+	}
+	slices.Reverse(rows)
+	return rows[max(len(rows)-n, 0):]
+}
+
+// wrap breaks text into rows of at most width characters. ANSI color
+// sequences take up no room; the transcript only lets through its own, as
+// it sanitizes text from the server. Other control characters are replaced
+// too, and tabs become spaces.
+func wrap(text string, width int) []string {
+	var rows []string
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(text); {
+		if strings.HasPrefix(text[i:], "\x1b[") {
+			end := i + 2
+			for end < len(text) && (text[end] < 0x40 || text[end] > 0x7e) {
+				end++
+			}
+			if end < len(text) && text[end] == 'm' {
+				b.WriteString(text[i : end+1])
+			}
+			i = min(end+1, len(text))
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(text[i:])
+		i += size
+		if n == width {
+			rows = append(rows, b.String())
+			b.Reset()
+			n = 0
+		}
+		if r == '\t' {
+			r = ' '
+		} else if unicode.IsControl(r) {
+			r = '?'
+		}
+		b.WriteRune(r)
+		n++
+	}
+	return append(rows, b.String())
+}
+
+// truncate cuts s to at most width characters.
+func truncate(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	return string([]rune(s)[:width])
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// clientInfo is one entry in the /admin/clients listing.
+type clientInfo struct {
+	Username    string    `json:"username"`
+	RemoteIP    string    `json:"remote_ip"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Rooms       []string  `json:"rooms"`
+	QueueDepth  int       `json:"queue_depth"`
+}
+
+// AdminClientsHandler lists every connected client as JSON. Requests must
+// carry "Authorization: Bearer <token>" matching the configured admin token;
+// with no token configured the endpoint is disabled.
+func AdminClientsHandler(w http.ResponseWriter, r *http.Request, token string, logger *log.Logger) {
+	if token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		logger.Printf("[WARN] Rejected admin request from %s", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(globalHub.snapshot()); err != nil {
+		logger.Printf("Error encoding admin response: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Event types exchanged with clients after the username handshake.
+const (
+	eventMessage   = "message"     // new chat message (client -> server -> all)
+	eventEdit      = "edit"        // edit a message by ID
+	eventDelete    = "delete"      // delete a message by ID
+	eventReact     = "react"       // toggle an emoji reaction on a message (client -> server)
+	eventReactions = "reactions"   // aggregated reaction counts for a message (server -> all)
+	eventError     = "error"       // a request from this client was rejected (server -> client)
+	eventJoin      = "join"        // join a room (client -> server), or someone joined (server -> room)
+	eventLeave     = "leave"       // leave a room (client -> server), or someone left (server -> room)
+	eventTyping    = "typing"      // ephemeral "user is typing" notice, throttled per user and room
+	eventRead      = "read"        // read marker: user has seen everything up to message ID in room
+	eventPrivate   = "private"     // end-to-end encrypted direct message, kept in the mailbox while offline
+	eventKey       = "key"         // publish own X25519 public key (client -> server), or a user's key (server -> client)
+	eventKeyReq    = "key_request" // ask for the public key of user To (client -> server)
+	eventNotice    = "notice"      // informational message for this client only (server -> client)
+)
+
+// defaultRoom is the room every client is placed in on connect and the room
+// used for events that don't name one.
+const defaultRoom = "lobby"
+
+// event is the JSON envelope for every frame after the username.
+// Older clients that send bare text are still understood: anything that
+// isn't a JSON object with a "type" is treated as a chat message.
+type event struct {
+	Type      string         `json:"type"`
+	ID        string         `json:"id,omitempty"`
+	Room      string         `json:"room,omitempty"`
+	From      string         `json:"from,omitempty"`
+	To        string         `json:"to,omitempty"`
+	Text      string         `json:"text,omitempty"`
+	Emoji     string         `json:"emoji,omitempty"`
+	Reactions map[string]int `json:"reactions,omitempty"`
+	Edited    bool           `json:"edited,omitempty"`
+	Time      time.Time      `json:"time,omitzero"`
+	Offline   bool           `json:"offline,omitempty"` // delivered from the mailbox after login
+
+	// Encrypted private messages carry the sender's public key, the AEAD
+	// nonce and the ciphertext. The server relays them without reading.
+	Key        []byte `json:"key,omitempty"`
+	Nonce      []byte `json:"nonce,omitempty"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+}
+
+// decodeEvent parses a text frame from a client.
+func decodeEvent(payload []byte) event {
+	var ev event
+	if err := json.Unmarshal(payload, &ev); err != nil || ev.Type == "" {
+		return event{Type: eventMessage, Text: string(payload)}
+	}
+	return ev
+}
+
+// encodeEvent marshals an event for sending. The struct only contains
+// JSON-safe fields, so an error here is a programming bug.
+func encodeEvent(ev event) []byte {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// chatMessage is a message the hub still remembers, so that it can be
+// edited, deleted or reacted to after it was broadcast.
+type chatMessage struct {
+	ID     string
+	Room   string
+	From   string
+	Text   string
+	Time   time.Time
+	Edited bool
+
+	// seq orders messages so read markers only ever move forward.
+	seq uint64
+
+	// reactions maps emoji -> set of usernames who reacted with it.
+	reactions map[string]map[string]struct{}
+}
+
+func (m *chatMessage) event() event {
+	return event{
+		Type:   eventMessage,
+		ID:     m.ID,
+		Room:   m.Room,
+		From:   m.From,
+		Text:   m.Text,
+		Edited: m.Edited,
+		Time:   m.Time,
+	}
+}
+
+// reactionCounts aggregates the reaction sets into counts per emoji.
+func (m *chatMessage) reactionCounts() map[string]int {
+	counts := make(map[string]int, len(m.reactions))
+	for emoji, users := range m.reactions {
+		counts[emoji] = len(users)
+	}
+	return counts
+}
+
+// toggleReaction adds the user's reaction, or removes it if already present.
+func (m *chatMessage) toggleReaction(emoji, username string) {
+	if m.reactions == nil {
+		m.reactions = make(map[string]map[string]struct{})
+	}
+	users := m.reactions[emoji]
+	if _, ok := users[username]; ok {
+		delete(users, username)
+		if len(users) == 0 {
+			delete(m.reactions, emoji)
+		}
+		return
+	}
+	if users == nil {
+		users = make(map[string]struct{})
+		m.reactions[emoji] = users
+	}
+	users[username] = struct{}{}
+}
+
+// validRoomName reports whether name is 1-32 letters, digits, '-' or '_'.
+func validRoomName(name string) bool {
+	if name == "" || len(name) > 32 {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newMessageID returns a random 12 hex character message ID.
+func newMessageID() string {
+	var b [6]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
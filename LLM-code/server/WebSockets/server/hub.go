@@ -0,0 +1,583 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxHistory bounds how many recent messages the hub remembers for edits,
+// deletes, reactions and read markers.
+const maxHistory = 1000
+
+// typingInterval is the minimum time between relayed typing notices from the
+// same user in the same room. Extra notices inside the window are dropped.
+const typingInterval = 2 * time.Second
+
+// hub manages all active clients and broadcasts messages to them
+type hub struct {
+	mu         sync.Mutex
+	clients    map[*client]struct{}
+	rooms      map[string]map[*client]struct{}
+	logger     *log.Logger
+	moderators map[string]struct{}
+	mailboxes  *mailboxStore
+	online     map[string]int // username -> number of connections
+
+	// messages holds recent messages by ID; order lists their IDs oldest
+	// first so the oldest can be evicted once maxHistory is reached.
+	messages map[string]*chatMessage
+	order    []string
+	seq      uint64
+
+	// readMarkers maps room -> username -> last message ID they have seen.
+	readMarkers map[string]map[string]string
+}
+
+func newHub(logger *log.Logger, moderators []string, mailboxes *mailboxStore) *hub {
+	h := &hub{
+		clients:     make(map[*client]struct{}),
+		rooms:       make(map[string]map[*client]struct{}),
+		logger:      logger,
+		moderators:  make(map[string]struct{}),
+		mailboxes:   mailboxes,
+		online:      make(map[string]int),
+		messages:    make(map[string]*chatMessage),
+		readMarkers: make(map[string]map[string]string),
+	}
+	for _, m := range moderators {
+		if m = strings.TrimSpace(m); m != "" {
+			h.moderators[m] = struct{}{}
+		}
+	}
+	return h
+}
+
+// register adds a client to the hub, places it in the default room and
+// delivers anything that was kept in the user's mailbox while they were
+// offline. Doing this under h.mu means nothing sent meanwhile can slip
+// into the mailbox after it was emptied.
+func (h *hub) register(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[c] = struct{}{}
+	h.online[c.username]++
+	globalMetrics.connectedClients.Add(1)
+	h.logger.Printf("[INFO] User '%s' connected.", c.username)
+	h.joinLocked(c, defaultRoom)
+
+	pending := h.mailboxes.take(c.username)
+	for _, ev := range pending {
+		ev.Offline = true
+		c.send(encodeEvent(ev))
+	}
+	if len(pending) > 0 {
+		h.logger.Printf("[INFO] Delivered %d stored message(s) to '%s'.", len(pending), c.username)
+	}
+}
+
+func (h *hub) unregister(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// Leave in a fixed order, so the events others see are reproducible
+	// (session replays compare them).
+	rooms := make([]string, 0, len(c.rooms))
+	for room := range c.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	for _, room := range rooms {
+		h.leaveLocked(c, room)
+	}
+	delete(h.clients, c)
+	h.online[c.username]--
+	if h.online[c.username] <= 0 {
+		delete(h.online, c.username)
+	}
+	globalMetrics.connectedClients.Add(-1)
+	h.logger.Printf("[INFO] User '%s' disconnected.", c.username)
+}
+
+// snapshot describes every connected client for the admin endpoint, oldest
+// connection first.
+func (h *hub) snapshot() []clientInfo {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	infos := make([]clientInfo, 0, len(h.clients))
+	for c := range h.clients {
+		rooms := make([]string, 0, len(c.rooms))
+		for room := range c.rooms {
+			rooms = append(rooms, room)
+		}
+		sort.Strings(rooms)
+		infos = append(infos, clientInfo{
+			Username:    c.username,
+			RemoteIP:    c.remoteIP,
+			ConnectedAt: c.connectedAt,
+			Rooms:       rooms,
+			QueueDepth:  c.queueDepth(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ConnectedAt.Before(infos[j].ConnectedAt) })
+	return infos
+}
+
+// handle dispatches a decoded event from a client. Rejected requests are
+// reported back to the sender only.
+func (h *hub) handle(sender *client, ev event) {
+	if ev.Room == "" {
+		ev.Room = defaultRoom
+	}
+	var err error
+	switch ev.Type {
+	case eventMessage:
+		err = h.broadcast(sender, ev.Room, []byte(ev.Text))
+	case eventEdit:
+		err = h.edit(sender, ev.ID, ev.Text)
+	case eventDelete:
+		err = h.remove(sender, ev.ID)
+	case eventReact:
+		err = h.react(sender, ev.ID, ev.Emoji)
+	case eventJoin:
+		err = h.join(sender, ev.Room)
+	case eventLeave:
+		err = h.leave(sender, ev.Room)
+	case eventTyping:
+		err = h.typing(sender, ev.Room)
+	case eventRead:
+		err = h.markRead(sender, ev.Room, ev.ID)
+	case eventPrivate:
+		err = h.private(sender, ev)
+	case eventKey:
+		err = h.publishKey(sender, ev.Key)
+	case eventKeyReq:
+		err = h.sendKey(sender, ev.To)
+	default:
+		err = fmt.Errorf("unknown event type %q", ev.Type)
+	}
+	if err != nil {
+		sender.send(encodeEvent(event{Type: eventError, ID: ev.ID, Room: ev.Room, To: ev.To, Text: err.Error()}))
+	}
+}
+
+func (h *hub) broadcast(sender *client, room string, msg []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !sender.inRoom(room) {
+		return fmt.Errorf("join #%s before sending to it", room)
+	}
+	h.seq++
+	m := &chatMessage{
+		ID:   newMessageID(),
+		Room: room,
+		From: sender.username,
+		Text: string(msg),
+		Time: time.Now().UTC(),
+		seq:  h.seq,
+	}
+	h.remember(m)
+	h.logger.Printf("[MESSAGE] %s #%s %s: %s", m.ID, m.Room, m.From, m.Text)
+	h.sendRoom(m.Room, encodeEvent(m.event()))
+
+	for _, name := range mentions(m.Text) {
+		name = html.EscapeString(name)
+		if h.online[name] == 0 && h.mailboxes.known(name) {
+			h.store(name, m.event())
+		}
+	}
+	return nil
+}
+
+// private relays an end-to-end encrypted direct message to every connection
+// of its recipient, echoing it to the sender. If the recipient is offline it
+// is kept in their mailbox instead. Plaintext private messages are refused:
+// the server only ever sees the ciphertext.
+func (h *hub) private(sender *client, in event) error {
+	to := html.EscapeString(strings.TrimSpace(in.To))
+	if to == "" {
+		return errors.New("private messages need a recipient")
+	}
+	if in.Text != "" || len(in.Ciphertext) == 0 || len(in.Nonce) == 0 || len(in.Key) == 0 {
+		return errors.New("private messages must be end-to-end encrypted")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ev := event{
+		Type:       eventPrivate,
+		ID:         newMessageID(),
+		From:       sender.username,
+		To:         to,
+		Time:       time.Now().UTC(),
+		Key:        in.Key,
+		Nonce:      in.Nonce,
+		Ciphertext: in.Ciphertext,
+	}
+	h.logger.Printf("[PRIVATE] %s %s -> %s (%d encrypted bytes)", ev.ID, ev.From, ev.To, len(ev.Ciphertext))
+	msg := encodeEvent(ev)
+
+	if h.online[to] == 0 {
+		if !h.mailboxes.known(to) {
+			return fmt.Errorf("no such user %q", to)
+		}
+		h.store(to, ev)
+		sender.send(msg)
+		sender.send(encodeEvent(event{Type: eventNotice, Text: to + " is offline; the message will be delivered when they log in"}))
+		return nil
+	}
+	for c := range h.clients {
+		if c.username == to && c != sender {
+			c.send(msg)
+		}
+	}
+	sender.send(msg)
+	return nil
+}
+
+// publishKey records the sender's X25519 public key so others can encrypt
+// private messages to them, even while they are offline.
+func (h *hub) publishKey(sender *client, key []byte) error {
+	if len(key) != 32 {
+		return errors.New("public keys must be 32 bytes")
+	}
+	if err := h.mailboxes.setKey(sender.username, key); err != nil {
+		h.logger.Printf("[ERROR] Saving key for '%s': %v", sender.username, err)
+		return errors.New("could not save public key")
+	}
+	return nil
+}
+
+// sendKey answers a key request with user's published public key.
+func (h *hub) sendKey(sender *client, user string) error {
+	user = html.EscapeString(strings.TrimSpace(user))
+	key := h.mailboxes.key(user)
+	if key == nil {
+		return fmt.Errorf("%s has not published an encryption key", user)
+	}
+	sender.send(encodeEvent(event{Type: eventKey, From: user, Key: key}))
+	return nil
+}
+
+// store keeps ev in an offline user's mailbox. Callers must hold h.mu.
+func (h *hub) store(user string, ev event) {
+	if err := h.mailboxes.put(user, ev); err != nil {
+		h.logger.Printf("[ERROR] Mailbox for '%s': %v", user, err)
+		return
+	}
+	h.logger.Printf("[INFO] Stored %s %s for offline user '%s'.", ev.Type, ev.ID, user)
+}
+
+func (h *hub) edit(sender *client, id, text string) error {
+	if strings.TrimSpace(text) == "" {
+		return errors.New("edited text must not be empty")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m, err := h.lookupOwned(sender, id)
+	if err != nil {
+		return err
+	}
+	m.Text = text
+	m.Edited = true
+	h.logger.Printf("[EDIT] %s by %s: %s", m.ID, sender.username, m.Text)
+	h.sendRoom(m.Room, encodeEvent(event{Type: eventEdit, ID: m.ID, Room: m.Room, From: m.From, Text: m.Text, Edited: true}))
+	return nil
+}
+
+func (h *hub) remove(sender *client, id string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m, err := h.lookupOwned(sender, id)
+	if err != nil {
+		return err
+	}
+	h.forget(m.ID)
+	h.logger.Printf("[DELETE] %s by %s", m.ID, sender.username)
+	h.sendRoom(m.Room, encodeEvent(event{Type: eventDelete, ID: m.ID, Room: m.Room}))
+	return nil
+}
+
+func (h *hub) react(sender *client, id, emoji string) error {
+	emoji = strings.TrimSpace(emoji)
+	if emoji == "" || len(emoji) > 32 || strings.ContainsAny(emoji, " \t\r\n") {
+		return errors.New("invalid reaction")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m, ok := h.messages[id]
+	if !ok || !sender.inRoom(m.Room) {
+		return errors.New("message not found")
+	}
+	m.toggleReaction(emoji, sender.username)
+	h.sendRoom(m.Room, encodeEvent(event{Type: eventReactions, ID: m.ID, Room: m.Room, Reactions: m.reactionCounts()}))
+	return nil
+}
+
+func (h *hub) join(c *client, room string) error {
+	if !validRoomName(room) {
+		return errors.New("room names are 1-32 letters, digits, '-' or '_'")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c.inRoom(room) {
+		return nil
+	}
+	h.joinLocked(c, room)
+	return nil
+}
+
+// joinLocked adds c to room, announces it to the room and sends the
+// newcomer the room's current read markers. Callers must hold h.mu.
+func (h *hub) joinLocked(c *client, room string) {
+	members := h.rooms[room]
+	if members == nil {
+		members = make(map[*client]struct{})
+		h.rooms[room] = members
+	}
+	members[c] = struct{}{}
+	c.rooms[room] = struct{}{}
+	h.sendRoom(room, encodeEvent(event{Type: eventJoin, Room: room, From: c.username}))
+	for user, id := range h.readMarkers[room] {
+		c.send(encodeEvent(event{Type: eventRead, Room: room, From: user, ID: id}))
+	}
+}
+
+func (h *hub) leave(c *client, room string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !c.inRoom(room) {
+		return fmt.Errorf("not in #%s", room)
+	}
+	h.leaveLocked(c, room)
+	c.send(encodeEvent(event{Type: eventLeave, Room: room, From: c.username}))
+	return nil
+}
+
+// leaveLocked removes c from room and tells the remaining members.
+// Callers must hold h.mu.
+func (h *hub) leaveLocked(c *client, room string) {
+	delete(c.rooms, room)
+	delete(c.lastTyping, room)
+	members := h.rooms[room]
+	delete(members, c)
+	if len(members) == 0 {
+		delete(h.rooms, room)
+		return
+	}
+	h.sendRoom(room, encodeEvent(event{Type: eventLeave, Room: room, From: c.username}))
+}
+
+// typing relays a typing notice to the other members of room, at most once
+// per typingInterval per user and room.
+func (h *hub) typing(c *client, room string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !c.inRoom(room) {
+		return fmt.Errorf("not in #%s", room)
+	}
+	now := time.Now()
+	if now.Sub(c.lastTyping[room]) < typingInterval {
+		return nil
+	}
+	c.lastTyping[room] = now
+	msg := encodeEvent(event{Type: eventTyping, Room: room, From: c.username})
+	for member := range h.rooms[room] {
+		if member != c {
+			member.send(msg)
+		}
+	}
+	return nil
+}
+
+// markRead moves the sender's read marker in room forward to message id and
+// tells the room. Markers never move backwards.
+func (h *hub) markRead(c *client, room, id string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m, ok := h.messages[id]
+	if !ok || m.Room != room || !c.inRoom(room) {
+		return errors.New("message not found")
+	}
+	markers := h.readMarkers[room]
+	if markers == nil {
+		markers = make(map[string]string)
+		h.readMarkers[room] = markers
+	}
+	if prev, ok := h.messages[markers[c.username]]; ok && prev.seq >= m.seq {
+		return nil
+	}
+	markers[c.username] = m.ID
+	h.sendRoom(room, encodeEvent(event{Type: eventRead, Room: room, From: c.username, ID: m.ID}))
+	return nil
+}
+
+// lookupOwned finds a message the sender is allowed to modify: their own,
+// or any message if they are a moderator. Callers must hold h.mu.
+func (h *hub) lookupOwned(sender *client, id string) (*chatMessage, error) {
+	m, ok := h.messages[id]
+	if !ok || !sender.inRoom(m.Room) {
+		return nil, errors.New("message not found")
+	}
+	if m.From != sender.username && !h.isModerator(sender.username) {
+		return nil, errors.New("only the author or a moderator can change this message")
+	}
+	return m, nil
+}
+
+func (h *hub) isModerator(username string) bool {
+	_, ok := h.moderators[username]
+	return ok
+}
+
+// remember stores a new message, evicting the oldest past maxHistory.
+// Callers must hold h.mu.
+func (h *hub) remember(m *chatMessage) {
+	h.messages[m.ID] = m
+	h.order = append(h.order, m.ID)
+	for len(h.order) > maxHistory {
+		h.forget(h.order[0])
+	}
+}
+
+// forget drops a message from history, along with any read markers that
+// point at it. Callers must hold h.mu.
+func (h *hub) forget(id string) {
+	m, ok := h.messages[id]
+	if !ok {
+		return
+	}
+	delete(h.messages, id)
+	for i, oid := range h.order {
+		if oid == id {
+			h.order = append(h.order[:i], h.order[i+1:]...)
+			break
+		}
+	}
+	for user, marker := range h.readMarkers[m.Room] {
+		if marker == id {
+			delete(h.readMarkers[m.Room], user)
+		}
+	}
+}
+
+// sendRoom writes msg to every member of room. Callers must hold h.mu.
+func (h *hub) sendRoom(room string, msg []byte) {
+	for c := range h.rooms[room] {
+		c.send(msg)
+	}
+}
+
+// sendQueueSize is how many outgoing frames may wait for a slow client
+// before further messages to it are dropped.
+const sendQueueSize = 256
+
+// writeTimeout bounds each frame write, so a peer that stops reading can't
+// hold writeLoop, and shutdown waiting for it, forever.
+const writeTimeout = 10 * time.Second
+
+// frame is an outgoing WebSocket frame waiting in a client's send queue.
+type frame struct {
+	opcode  byte
+	payload []byte
+}
+
+type client struct {
+	conn        io.ReadWriteCloser
+	username    string
+	remoteIP    string
+	connectedAt time.Time
+
+	// queue feeds writeLoop, the only goroutine that writes to conn, so a
+	// slow client never blocks the hub. mu guards closed and sends on queue.
+	mu     sync.Mutex
+	queue  chan frame
+	closed bool
+	done   chan struct{}
+
+	// rooms and lastTyping are guarded by the hub's mutex.
+	rooms      map[string]struct{}
+	lastTyping map[string]time.Time
+}
+
+func newClient(conn io.ReadWriteCloser, username, remoteIP string) *client {
+	return &client{
+		conn:        conn,
+		username:    username,
+		remoteIP:    remoteIP,
+		connectedAt: time.Now().UTC(),
+		queue:       make(chan frame, sendQueueSize),
+		done:        make(chan struct{}),
+		rooms:       make(map[string]struct{}),
+		lastTyping:  make(map[string]time.Time),
+	}
+}
+
+func (c *client) inRoom(room string) bool {
+	_, ok := c.rooms[room]
+	return ok
+}
+
+// send queues a text frame for the client.
+func (c *client) send(msg []byte) {
+	c.enqueue(frame{opcode: 0x1, payload: msg})
+}
+
+// enqueue adds f to the send queue without blocking. If the queue is full
+// the frame is dropped and counted; it reports whether f was queued.
+func (c *client) enqueue(f frame) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	select {
+	case c.queue <- f:
+		return true
+	default:
+		globalMetrics.messagesDropped.Add(1)
+		return false
+	}
+}
+
+// queueDepth reports how many frames are waiting to be written.
+func (c *client) queueDepth() int {
+	return len(c.queue)
+}
+
+// writeLoop writes queued frames to the connection until the queue is
+// closed. A write error or timeout closes the connection, which also ends
+// the reader.
+func (c *client) writeLoop() {
+	defer close(c.done)
+	deadline, _ := c.conn.(interface{ SetWriteDeadline(time.Time) error })
+	for f := range c.queue {
+		if deadline != nil {
+			deadline.SetWriteDeadline(time.Now().Add(writeTimeout))
+		}
+		if err := writeWebSocketFrame(c.conn, f.opcode, f.payload); err != nil {
+			c.conn.Close()
+			return
+		}
+		if f.opcode == 0x1 {
+			globalMetrics.messagesSent.Add(1)
+		}
+		globalMetrics.bytesSent.Add(uint64(len(f.payload)))
+	}
+}
+
+// shutdown stops accepting frames and waits for writeLoop to flush what is
+// already queued.
+func (c *client) shutdown() {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	c.mu.Unlock()
+	<-c.done
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mailboxStore keeps private messages and mentions for users who are not
+// connected, and hands them over in order on their next login. Each known
+// user has one JSON file in dir, so mailboxes survive restarts. Changes are
+// made in memory and the files rewritten atomically by one goroutine,
+// writeLoop, so callers (the hub, under its lock) never wait for the disk.
+// A user becomes known on first login; messages for names that have never
+// logged in are not stored. The file also holds the user's published public
+// key for encrypted private messages.
+//
+// Usernames are chosen by clients, so known users are bounded: a user who
+// has not logged in for ttl and has nothing waiting is forgotten, and
+// beyond maxKnownUsers new names get no mailbox.
+type mailboxStore struct {
+	mu      sync.Mutex
+	dir     string
+	ttl     time.Duration
+	maxSize int
+	boxes   map[string][]event
+	keys    map[string][]byte
+	seen    map[string]time.Time // last login
+	dirty   map[string]struct{}  // users whose file is out of date
+	wake    chan struct{}
+	closed  bool
+	done    chan struct{} // closed when writeLoop has finished
+	logger  *log.Logger
+}
+
+// maxKnownUsers caps the users the store keeps a mailbox for.
+const maxKnownUsers = 10_000
+
+// mailboxFile is the on-disk format of one user's mailbox.
+type mailboxFile struct {
+	User     string    `json:"user"`
+	Key      []byte    `json:"key,omitempty"`
+	Seen     time.Time `json:"seen,omitzero"`
+	Messages []event   `json:"messages"`
+}
+
+// openMailboxes loads every mailbox in dir, creating the directory if
+// needed, and drops messages and users that have already expired.
+func openMailboxes(dir string, ttl time.Duration, maxSize int, logger *log.Logger) (*mailboxStore, error) {
+	if ttl <= 0 {
+		return nil, errors.New("mailbox expiry must be positive")
+	}
+	if maxSize < 1 || maxSize > sendQueueSize/2 {
+		return nil, fmt.Errorf("mailbox size must be between 1 and %d", sendQueueSize/2)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &mailboxStore{
+		dir:     dir,
+		ttl:     ttl,
+		maxSize: maxSize,
+		boxes:   make(map[string][]event),
+		keys:    make(map[string][]byte),
+		seen:    make(map[string]time.Time),
+		dirty:   make(map[string]struct{}),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		logger:  logger,
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var mf mailboxFile
+		if err := json.Unmarshal(data, &mf); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		s.boxes[mf.User] = s.prune(mf.Messages)
+		if mf.Key != nil {
+			s.keys[mf.User] = mf.Key
+		}
+		if mf.Seen.IsZero() {
+			mf.Seen = time.Now() // written before logins were recorded
+		}
+		s.seen[mf.User] = mf.Seen
+	}
+	s.forgetLocked(time.Now())
+	go s.writeLoop()
+	return s, nil
+}
+
+// known reports whether user has logged in before.
+func (s *mailboxStore) known(user string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.boxes[user]
+	return ok
+}
+
+// key returns user's published public key, or nil.
+func (s *mailboxStore) key(user string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys[user]
+}
+
+// setKey records user's public key, replacing any earlier one. Clients pin
+// keys they have seen, so a replaced key is flagged on their side.
+func (s *mailboxStore) setKey(user string, key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.boxes[user]; !ok {
+		return fmt.Errorf("unknown user %q", user)
+	}
+	s.keys[user] = key
+	s.saveLocked(user)
+	return nil
+}
+
+// put stores ev for user, discarding the oldest messages beyond maxSize.
+func (s *mailboxStore) put(user string, ev event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	box, ok := s.boxes[user]
+	if !ok {
+		return fmt.Errorf("unknown user %q", user)
+	}
+	box = append(s.prune(box), ev)
+	if over := len(box) - s.maxSize; over > 0 {
+		box = box[over:]
+	}
+	s.boxes[user] = box
+	s.saveLocked(user)
+	return nil
+}
+
+// take returns and clears user's pending messages, oldest first. It also
+// registers user as known, so later messages can be kept for them, unless
+// maxKnownUsers has been reached.
+func (s *mailboxStore) take(user string) []event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	box, ok := s.boxes[user]
+	if !ok && len(s.boxes) >= maxKnownUsers {
+		s.forgetLocked(now)
+		if len(s.boxes) >= maxKnownUsers {
+			s.logger.Printf("[WARN] %d users have mailboxes; not keeping one for '%s'.", len(s.boxes), user)
+			return nil
+		}
+	}
+	s.boxes[user] = nil
+	s.seen[user] = now
+	s.saveLocked(user)
+	return s.prune(box)
+}
+
+// forgetLocked drops users who have not logged in for ttl and have no
+// messages waiting, and deletes their files. Callers must hold s.mu.
+func (s *mailboxStore) forgetLocked(now time.Time) {
+	for user, box := range s.boxes {
+		if now.Sub(s.seen[user]) > s.ttl && len(s.prune(box)) == 0 {
+			delete(s.boxes, user)
+			delete(s.keys, user)
+			delete(s.seen, user)
+			s.saveLocked(user)
+		}
+	}
+}
+
+// prune drops expired messages. Callers must hold s.mu.
+func (s *mailboxStore) prune(box []event) []event {
+	cutoff := time.Now().Add(-s.ttl)
+	i := 0
+	for i < len(box) && box[i].Time.Before(cutoff) {
+		i++
+	}
+	return box[i:]
+}
+
+// saveLocked marks user's mailbox for writeLoop to write, or to delete if
+// the user has been forgotten. Callers must hold s.mu.
+func (s *mailboxStore) saveLocked(user string) {
+	s.dirty[user] = struct{}{}
+	if s.closed {
+		return
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default: // a wake-up is already pending
+	}
+}
+
+// close writes the mailboxes still marked and stops writeLoop. Changes
+// made after close are not saved.
+func (s *mailboxStore) close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.wake)
+	}
+	s.mu.Unlock()
+	<-s.done
+}
+
+// writeLoop writes the mailboxes marked by saveLocked until close.
+func (s *mailboxStore) writeLoop() {
+	defer close(s.done)
+	for range s.wake {
+		s.flush()
+	}
+	s.flush()
+}
+
+// flush writes the marked mailboxes. It snapshots them under s.mu and does
+// the file I/O without it.
+func (s *mailboxStore) flush() {
+	s.mu.Lock()
+	files := make(map[string][]byte, len(s.dirty))
+	for user := range s.dirty {
+		box, ok := s.boxes[user]
+		if !ok {
+			files[user] = nil
+			continue
+		}
+		data, err := json.Marshal(mailboxFile{User: user, Key: s.keys[user], Seen: s.seen[user], Messages: box})
+		if err != nil {
+			s.logger.Printf("[ERROR] Mailbox for '%s': %v", user, err)
+			continue
+		}
+		files[user] = data
+	}
+	clear(s.dirty)
+	s.mu.Unlock()
+
+	for user, data := range files {
+		if err := s.write(user, data); err != nil {
+			s.logger.Printf("[ERROR] Mailbox for '%s': %v", user, err)
+		}
+	}
+}
+
+// write replaces user's mailbox file via a temporary file and rename, or
+// removes it if data is nil.
+func (s *mailboxStore) write(user string, data []byte) error {
+	name := filepath.Join(s.dir, hex.EncodeToString([]byte(user))+".json")
+	if data == nil {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	tmp, err := os.CreateTemp(s.dir, ".mailbox-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// mentions returns the distinct usernames mentioned as "@name" in text.
+func mentions(text string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, word := range strings.Fields(text) {
+		name, ok := strings.CutPrefix(word, "@")
+		if !ok {
+			continue
+		}
+		name = strings.TrimRight(name, ".,:;!?)")
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
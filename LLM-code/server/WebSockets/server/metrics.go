@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// metrics holds the server's counters. Everything is updated atomically so
+// the hot paths (frame reads and writes) never take a lock for it.
+type metrics struct {
+	connectedClients  atomic.Int64
+	messagesReceived  atomic.Uint64
+	messagesSent      atomic.Uint64
+	bytesReceived     atomic.Uint64
+	bytesSent         atomic.Uint64
+	messagesDropped   atomic.Uint64
+	handshakeFailures atomic.Uint64
+}
+
+var globalMetrics metrics
+
+// MetricsHandler serves the counters in the Prometheus text exposition format.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m := &globalMetrics
+	writeMetric(w, "chat_connected_clients", "gauge",
+		"Number of currently connected WebSocket clients.", m.connectedClients.Load())
+	writeMetric(w, "chat_messages_received_total", "counter",
+		"WebSocket data frames received from clients.", m.messagesReceived.Load())
+	writeMetric(w, "chat_messages_sent_total", "counter",
+		"WebSocket data frames written to clients.", m.messagesSent.Load())
+	writeMetric(w, "chat_bytes_received_total", "counter",
+		"Payload bytes received from clients.", m.bytesReceived.Load())
+	writeMetric(w, "chat_bytes_sent_total", "counter",
+		"Payload bytes written to clients.", m.bytesSent.Load())
+	writeMetric(w, "chat_messages_dropped_total", "counter",
+		"Outgoing messages dropped because a client's send queue was full.", m.messagesDropped.Load())
+	writeMetric(w, "chat_handshake_failures_total", "counter",
+		"WebSocket upgrade attempts that failed before the client joined.", m.handshakeFailures.Load())
+}
+
+func writeMetric[T int64 | uint64](w http.ResponseWriter, name, kind, help string, value T) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
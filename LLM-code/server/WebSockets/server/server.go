@@ -2,73 +2,34 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"errors"
+	"flag"
 	"fmt"
 	"html"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 )
 
-// hub manages all active clients and broadcasts messages to them
-type hub struct {
-	mu      sync.Mutex
-	clients map[*client]struct{}
-	logger  *log.Logger
-}
-
-func newHub(logger *log.Logger) *hub {
-	return &hub{
-		clients: make(map[*client]struct{}),
-		logger:  logger,
-	}
-}
-
-func (h *hub) register(c *client) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	h.clients[c] = struct{}{}
-	h.logger.Printf("[INFO] User '%s' connected.", c.username)
-}
-
-func (h *hub) unregister(c *client) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	delete(h.clients, c)
-	h.logger.Printf("[INFO] User '%s' disconnected.", c.username)
-}
-
-func (h *hub) broadcast(sender *client, msg []byte) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	message := fmt.Sprintf("%s: %s", sender.username, string(msg))
-	h.logger.Printf("[MESSAGE] %s", message)
-	for c := range h.clients {
-		c.send([]byte(message))
-	}
-}
-
-type client struct {
-	conn     io.ReadWriteCloser
-	username string
-	mu       sync.Mutex
-}
-
-func (c *client) send(msg []byte) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return writeWebSocketFrame(c.conn, 0x1, msg)
-}
-
 var globalHub *hub
 
 func main() {
+	moderators := flag.String("moderators", "", "comma-separated usernames allowed to edit or delete any message")
+	mailboxDir := flag.String("mailbox-dir", "mailboxes", "directory for offline users' stored messages")
+	mailboxTTL := flag.Duration("mailbox-ttl", 7*24*time.Hour, "how long stored messages are kept")
+	mailboxSize := flag.Int("mailbox-size", 100, "maximum stored messages per user; the oldest are dropped")
+	adminToken := flag.String("admin-token", os.Getenv("CHAT_ADMIN_TOKEN"), "bearer token for /admin/clients (default $CHAT_ADMIN_TOKEN; empty disables it)")
+	flag.Parse()
+
 	// Set up logging to file and stdout
 	logFile, err := os.OpenFile("activity.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
@@ -77,12 +38,21 @@ func main() {
 	multiWriter := io.MultiWriter(os.Stdout, logFile)
 	logger := log.New(multiWriter, "", log.LstdFlags)
 
-	globalHub = newHub(logger)
+	mailboxes, err := openMailboxes(*mailboxDir, *mailboxTTL, *mailboxSize, logger)
+	if err != nil {
+		logger.Fatalf("Failed to open mailboxes: %v", err)
+	}
+
+	globalHub = newHub(logger, strings.Split(*moderators, ","), mailboxes)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		WebSocketHandler(w, r, logger)
 	})
+	mux.HandleFunc("GET /metrics", MetricsHandler)
+	mux.HandleFunc("GET /admin/clients", func(w http.ResponseWriter, r *http.Request) {
+		AdminClientsHandler(w, r, *adminToken, logger)
+	})
 
 	server := &http.Server{
 		Addr:         ":8080",
@@ -91,15 +61,29 @@ func main() {
 		WriteTimeout: 5 * time.Second,
 	}
 
+	// On SIGINT or SIGTERM stop accepting connections and write the
+	// mailboxes still pending before exiting.
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		logger.Println("[INFO] Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
 	logger.Println("[INFO] Server starting on :8080")
 
 	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		logger.Fatalf("ListenAndServe error: %v", err)
 	}
+	mailboxes.close()
 }
 
 func WebSocketHandler(w http.ResponseWriter, r *http.Request, logger *log.Logger) {
 	if !isWebSocketUpgrade(r) {
+		globalMetrics.handshakeFailures.Add(1)
 		http.Error(w, "Not a WebSocket handshake", http.StatusBadRequest)
 		return
 	}
@@ -107,6 +91,7 @@ func WebSocketHandler(w http.ResponseWriter, r *http.Request, logger *log.Logger
 	rc := http.NewResponseController(w)
 	conn, brw, err := rc.Hijack()
 	if err != nil {
+		globalMetrics.handshakeFailures.Add(1)
 		logger.Printf("Hijack error: %v", err)
 		return
 	}
@@ -119,6 +104,7 @@ func WebSocketHandler(w http.ResponseWriter, r *http.Request, logger *log.Logger
 		"Connection: Upgrade\r\n"+
 		"Sec-WebSocket-Accept: %s\r\n\r\n", acceptKey)
 	if _, err := io.WriteString(conn, resp); err != nil {
+		globalMetrics.handshakeFailures.Add(1)
 		logger.Printf("Error writing handshake response: %v", err)
 		conn.Close()
 		return
@@ -127,6 +113,7 @@ func WebSocketHandler(w http.ResponseWriter, r *http.Request, logger *log.Logger
 	// The first message from the client should be their username
 	opcode, payload, err := readWebSocketFrame(brw)
 	if err != nil {
+		globalMetrics.handshakeFailures.Add(1)
 		logger.Printf("Error reading username frame: %v", err)
 		conn.Close()
 		return
@@ -141,10 +128,16 @@ func WebSocketHandler(w http.ResponseWriter, r *http.Request, logger *log.Logger
 		username = "Anonymous"
 	}
 
-	c := &client{conn: conn, username: html.EscapeString(username)}
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	c := newClient(conn, html.EscapeString(username), remoteIP)
+	go c.writeLoop()
 	globalHub.register(c)
 	defer func() {
 		globalHub.unregister(c)
+		c.shutdown()
 		conn.Close()
 	}()
 
@@ -155,14 +148,22 @@ func WebSocketHandler(w http.ResponseWriter, r *http.Request, logger *log.Logger
 			logger.Printf("Read frame error: %v", err)
 			return
 		}
+		globalMetrics.bytesReceived.Add(uint64(len(payload)))
 		if opcode == 0x8 {
-			// Close frame
-			writeWebSocketFrame(conn, 0x8, []byte{})
+			// Close frame: echo it, flushed by the writer before we hang up
+			c.enqueue(frame{opcode: 0x8})
 			return
 		}
+		if opcode == 0x9 {
+			// Ping: answer with a pong carrying the same payload, queued
+			// like everything else so it can't interleave with a frame
+			c.enqueue(frame{opcode: 0xA, payload: payload})
+			continue
+		}
 		if opcode == 0x1 {
-			// Text frame: broadcast
-			globalHub.broadcast(c, payload)
+			globalMetrics.messagesReceived.Add(1)
+			// Text frame: a chat message or an edit/delete/react request
+			globalHub.handle(c, decodeEvent(payload))
 		}
 	}
 }